@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const forwardedForHeader = "X-Forwarded-For"
+
+// ipAllowlist networks that requests are accepted from. An empty list allows
+// requests from anywhere.
+type ipAllowlist []*net.IPNet
+
+// parseAllowlist parses a list of CIDRs, where plain addresses are taken to be
+// single hosts.
+func parseAllowlist(cidrs []string) (ipAllowlist, error) {
+	list := make(ipAllowlist, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", cidr)
+		}
+		list = append(list, network)
+	}
+
+	return list, nil
+}
+
+func (l ipAllowlist) allows(addr string) bool {
+	if len(l) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether an address is in a non empty list.
+func (l ipAllowlist) contains(addr string) bool {
+	return len(l) > 0 && l.allows(addr)
+}
+
+// clientIP returns the address of the client of a request. X-Forwarded-For is
+// only used when the request comes from a trusted proxy, and then the client is
+// the last address in it which is not a trusted proxy itself.
+func clientIP(r *http.Request, trustedProxies ipAllowlist) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !trustedProxies.contains(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header[forwardedForHeader], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			break
+		}
+
+		ip = hop
+		if !trustedProxies.contains(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// checkTargetAllowlist verifies that a request comes from an address which may
+// deploy a target.
+func (e *env) checkTargetAllowlist(ctx *Context, target Target) (int, error) {
+	if len(target.AllowedIPs) == 0 {
+		return http.StatusOK, nil
+	}
+
+	allowlist, err := parseAllowlist(target.AllowedIPs)
+	if err != nil {
+		log.Errorw("Invalid allowlist", "service", target.ID, "error", err, "requestId", ctx.id)
+		return http.StatusInternalServerError, errInternalError
+	}
+
+	if !allowlist.allows(ctx.ip) {
+		log.Warnw("Address not allowed to deploy target", "ip", ctx.ip, "service", target.ID, "requestId", ctx.id)
+		return http.StatusForbidden, errForbidden
+	}
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAllowlist(t *testing.T) {
+	assert := assert.New(t)
+
+	allowlist, err := parseAllowlist([]string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"})
+	assert.NoError(err)
+	assert.True(allowlist.allows("10.1.2.3"))
+	assert.True(allowlist.allows("192.168.1.10"))
+	assert.False(allowlist.allows("192.168.1.11"))
+	assert.True(allowlist.allows("fd00::1"))
+	assert.False(allowlist.allows("2001:db8::1"))
+	assert.False(allowlist.allows("not-an-ip"))
+
+	var empty ipAllowlist
+	assert.True(empty.allows("203.0.113.1"))
+	assert.False(empty.contains("203.0.113.1"))
+
+	_, err = parseAllowlist([]string{"10.0.0.0/33"})
+	assert.Error(err)
+	_, err = parseAllowlist([]string{"example.com"})
+	assert.Error(err)
+}
+
+func TestClientIP(t *testing.T) {
+	assert := assert.New(t)
+	proxies, err := parseAllowlist([]string{"10.0.0.0/8"})
+	assert.NoError(err)
+
+	req := createTestRequest("/health", http.MethodGet, nil)
+	req.RemoteAddr = "203.0.113.1:4000"
+	req.Header.Set(forwardedForHeader, "198.51.100.7")
+	assert.Equal("203.0.113.1", clientIP(req, proxies))
+	assert.Equal("203.0.113.1", clientIP(req, nil))
+
+	req.RemoteAddr = "10.0.0.2:4000"
+	assert.Equal("198.51.100.7", clientIP(req, proxies))
+
+	req.Header.Set(forwardedForHeader, "192.0.2.66, 198.51.100.7, 10.0.0.3")
+	assert.Equal("198.51.100.7", clientIP(req, proxies))
+
+	req.Header.Del(forwardedForHeader)
+	req.Header.Add(forwardedForHeader, "192.0.2.66")
+	req.Header.Add(forwardedForHeader, "198.51.100.8")
+	assert.Equal("198.51.100.8", clientIP(req, proxies))
+
+	req.Header.Set(forwardedForHeader, "garbage, 10.0.0.3")
+	assert.Equal("10.0.0.3", clientIP(req, proxies))
+
+	req.Header.Del(forwardedForHeader)
+	assert.Equal("10.0.0.2", clientIP(req, proxies))
+}
+
+func TestRedeploy_allowlists(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			AllowedIPs:     []string{"192.0.2.0/24", "198.51.100.0/24"},
+			TrustedProxies: []string{"10.0.0.1"},
+			RouteAllowedIPs: map[string][]string{
+				"/redeploy": []string{"192.0.2.0/24"},
+			},
+			Services: map[string]Target{
+				"test-svc": Target{
+					ID:         "test-svc",
+					Binary:     "/bin/sh",
+					Script:     "./resources/test-svc.sh",
+					MustMatch:  "^repository/svc:.*",
+					AllowedIPs: []string{"192.0.2.10"},
+				},
+			},
+		},
+		docker:    &mockDockerClient{},
+		approvals: newApprovalStore(),
+	}
+	server := newServer(e, 9000)
+
+	redeployImage := func(remoteAddr, forwardedFor, image string) int {
+		req := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+			Target: "test-svc",
+			Image:  image,
+		})
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set(forwardedForHeader, forwardedFor)
+		}
+		req.Header.Set(tokenHeader, deployToken)
+		return performTestRequest(server.Handler, req).Code
+	}
+	redeploy := func(remoteAddr, forwardedFor string) int {
+		return redeployImage(remoteAddr, forwardedFor, "repository/svc:1.1")
+	}
+
+	assert.Equal(http.StatusForbidden, redeploy("203.0.113.1:4000", ""))
+	assert.Equal(http.StatusForbidden, redeploy("198.51.100.1:4000", ""))
+	assert.Equal(http.StatusForbidden, redeploy("192.0.2.11:4000", ""))
+	assert.Equal(http.StatusForbidden, redeploy("203.0.113.1:4000", "192.0.2.10"))
+	assert.Equal(http.StatusOK, redeploy("192.0.2.10:4000", ""))
+	assert.Equal(http.StatusOK, redeploy("10.0.0.1:4000", "192.0.2.10"))
+	assert.Equal(http.StatusForbidden, redeployImage("192.0.2.11:4000", "", "repository/svc:"))
+	assert.Equal(http.StatusBadRequest, redeployImage("192.0.2.10:4000", "", "repository/svc:"))
+
+	err := e.approvals.add(&PendingDeployment{ID: "pending", Target: "test-svc", Image: "repository/svc:1.1", Expires: time.Now().Add(time.Hour)})
+	assert.NoError(err)
+	reject := func(remoteAddr string) int {
+		req := createTestRequest("/deployments/pending/reject", http.MethodPost, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(tokenHeader, deployToken)
+		return performTestRequest(server.Handler, req).Code
+	}
+	assert.Equal(http.StatusForbidden, reject("192.0.2.11:4000"))
+	assert.Equal(http.StatusOK, reject("192.0.2.10:4000"))
+
+	req := createTestRequest("/health", http.MethodGet, nil)
+	req.RemoteAddr = "198.51.100.1:4000"
+	assert.Equal(http.StatusOK, performTestRequest(server.Handler, req).Code)
+
+	req = createTestRequest("/health", http.MethodGet, nil)
+	req.RemoteAddr = "203.0.113.1:4000"
+	assert.Equal(http.StatusForbidden, performTestRequest(server.Handler, req).Code)
+}
+
+func TestCheckRouteAllowlists(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newRouter(Config{
+		Authentication: AuthKey{
+			Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+			Salt: "478c1d403dec20707cf487f81c06d646",
+		},
+		RouteAllowedIPs: map[string][]string{
+			"/redeploy": []string{"192.0.2.0/24"},
+			"/metric":   []string{"192.0.2.0/24"},
+		},
+	})
+	r.GET("/metrics", serveMetrics, false)
+	r.POST("/redeploy", checkHealth, true)
+
+	err := r.checkRouteAllowlists()
+	assert.Error(err)
+	assert.Contains(err.Error(), "/metric")
+
+	delete(r.routes, "/metric")
+	assert.NoError(r.checkRouteAllowlists())
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultApprovalTimeout = time.Hour
+
+var (
+	errSelfApproval      = fmt.Errorf("Deployments must be approved by a different credential")
+	errDuplicateApproval = fmt.Errorf("Duplicate pending deployment")
+	errImageMismatch     = fmt.Errorf("Approved image does not match the pending deployment")
+)
+
+// PendingDeployment redeployment of a target which requires approval, waiting
+// for a second credential to approve or reject it. The image is pinned to the
+// digest it referred to when the deployment was requested, unless the target
+// deploys versions rather than images.
+type PendingDeployment struct {
+	ID          string    `json:"id"`
+	Target      string    `json:"target"`
+	Image       string    `json:"image"`
+	RequestedBy string    `json:"requestedBy"`
+	Requested   time.Time `json:"requested"`
+	Expires     time.Time `json:"expires"`
+
+	override bool
+	reason   string
+}
+
+// approvalStore pending deployments by id. Expired deployments are dropped when
+// the store is accessed.
+type approvalStore struct {
+	mu      sync.Mutex
+	pending map[string]*PendingDeployment
+}
+
+func newApprovalStore() *approvalStore {
+	return &approvalStore{
+		pending: make(map[string]*PendingDeployment),
+	}
+}
+
+// add records a pending deployment, which must not replace an existing one.
+func (s *approvalStore) add(d *PendingDeployment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(time.Now())
+	if _, ok := s.pending[d.ID]; ok {
+		return errDuplicateApproval
+	}
+	s.pending[d.ID] = d
+	return nil
+}
+
+// take removes a pending deployment and returns it, if it has not expired.
+func (s *approvalStore) take(id string) (*PendingDeployment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(time.Now())
+	d, ok := s.pending[id]
+	delete(s.pending, id)
+	return d, ok
+}
+
+// put returns a deployment that was taken but not decided on.
+func (s *approvalStore) put(d *PendingDeployment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[d.ID] = d
+}
+
+func (s *approvalStore) expire(now time.Time) {
+	for id, d := range s.pending {
+		if now.After(d.Expires) {
+			log.Infow("Pending deployment expired", "audit", true, "id", id, "service", d.Target, "image", d.Image, "requestedBy", d.RequestedBy)
+			delete(s.pending, id)
+		}
+	}
+}
+
+// ReviewRequest request body for approving a pending deployment, which must
+// repeat the pinned image that was reviewed.
+type ReviewRequest struct {
+	Image string `json:"image,omitempty"`
+}
+
+// requestApproval records a redeployment of a target which requires approval.
+func (e *env) requestApproval(ctx *Context, target Target, req RedeploymentRequest) (int, error) {
+	timeout := target.ApprovalTimeout
+	if timeout == 0 {
+		timeout = defaultApprovalTimeout
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return http.StatusInternalServerError, errInternalError
+	}
+
+	image := req.Image
+	if target.Type != typeSystemd {
+		image, err = e.pinDigest(ctx, req.Image)
+		if err != nil {
+			log.Errorw("Failed to resolve image digest", "image", req.Image, "error", err, "requestId", ctx.id)
+			return http.StatusInternalServerError, errInternalError
+		}
+	}
+
+	now := time.Now().UTC()
+	d := &PendingDeployment{
+		ID:          id.String(),
+		Target:      target.ID,
+		Image:       image,
+		RequestedBy: ctx.identity,
+		Requested:   now,
+		Expires:     now.Add(timeout),
+		override:    req.Override,
+		reason:      req.Reason,
+	}
+	err = e.approvals.add(d)
+	if err != nil {
+		log.Errorw("Failed to record pending deployment", "id", d.ID, "error", err, "requestId", ctx.id)
+		return http.StatusInternalServerError, errInternalError
+	}
+
+	log.Infow("Redeployment awaiting approval", "audit", true, "id", d.ID, "service", d.Target, "image", d.Image, "requestedBy", d.RequestedBy, "requestId", ctx.id)
+	return ctx.sendJSONStatus(d, http.StatusAccepted)
+}
+
+// reviewDeployment handles POST /deployments/{id}/approve and
+// POST /deployments/{id}/reject. Approval requires a different credential than
+// the one which requested the deployment, while either may reject it. Both
+// require an address and identity which are allowed to deploy the target, and approvals must
+// name the pinned image of the pending deployment. The policies and freezes of
+// the target are checked again on approval, as they may have changed while the
+// deployment was pending.
+func (e *env) reviewDeployment(ctx *Context) (int, error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(ctx.r.URL.Path, "/deployments/"), "/"), "/")
+	if len(parts) != 2 || (parts[1] != "approve" && parts[1] != "reject") {
+		return http.StatusNotFound, errNotFound
+	}
+	id, action := parts[0], parts[1]
+
+	d, ok := e.approvals.take(id)
+	if !ok {
+		return http.StatusNotFound, errNotFound
+	}
+
+	target, ok := e.cfg.Services[d.Target]
+	if !ok {
+		return http.StatusNotFound, errNotFound
+	}
+
+	status, err := e.checkTargetAllowlist(ctx, target)
+	if err != nil {
+		e.approvals.put(d)
+		return status, err
+	}
+
+	if !target.allowsIdentity(ctx.identity) {
+		e.approvals.put(d)
+		log.Warnw("Identity not allowed to review deployment", "audit", true, "id", d.ID, "identity", ctx.identity, "service", d.Target, "requestId", ctx.id)
+		return http.StatusForbidden, errForbidden
+	}
+
+	if action == "reject" {
+		log.Infow("Pending deployment rejected", "audit", true, "id", d.ID, "service", d.Target, "image", d.Image, "rejectedBy", ctx.identity, "requestId", ctx.id)
+		return ctx.sendJSON(ResponseMessage{
+			Message: "Redeployment rejected",
+		})
+	}
+
+	if ctx.identity == d.RequestedBy {
+		e.approvals.put(d)
+		log.Warnw("Rejected self approval", "audit", true, "id", d.ID, "credential", ctx.identity, "requestId", ctx.id)
+		return http.StatusForbidden, fmt.Errorf("%s: %s", errForbidden, errSelfApproval)
+	}
+
+	var review ReviewRequest
+	err = json.NewDecoder(ctx.r.Body).Decode(&review)
+	if err != nil {
+		e.approvals.put(d)
+		log.Errorw("Failed to parse request body", "error", err)
+		return http.StatusBadRequest, errBadRequest
+	}
+	if review.Image != d.Image {
+		e.approvals.put(d)
+		log.Warnw("Rejected approval of a different image", "audit", true, "id", d.ID, "image", d.Image, "approvedImage", review.Image, "credential", ctx.identity, "requestId", ctx.id)
+		return http.StatusConflict, errImageMismatch
+	}
+
+	deployCtx := &Context{
+		id:       d.ID,
+		ip:       ctx.ip,
+		identity: d.RequestedBy,
+		approver: ctx.identity,
+		start:    time.Now(),
+		Context:  context.Background(),
+	}
+	status, err = e.checkPolicies(deployCtx, target, d.Image)
+	if err == nil {
+		status, err = e.checkFreeze(deployCtx, target, RedeploymentRequest{
+			Target:   d.Target,
+			Image:    d.Image,
+			Override: d.override,
+			Reason:   d.reason,
+		})
+	}
+	if err != nil {
+		e.approvals.put(d)
+		log.Warnw("Rejected approval of a deployment the target no longer allows", "audit", true, "id", d.ID, "image", d.Image, "credential", ctx.identity, "error", err, "requestId", ctx.id)
+		return status, err
+	}
+
+	if status == http.StatusAccepted {
+		log.Infow("Pending deployment approved", "audit", true, "id", d.ID, "service", d.Target, "image", d.Image, "requestedBy", d.RequestedBy, "approvedBy", ctx.identity, "requestId", ctx.id)
+		go e.redeployAfterFreeze(deployCtx, target, d.Image)
+		return ctx.sendJSONStatus(ResponseMessage{
+			Message: "Redeployment approved and queued until freeze ends",
+		}, http.StatusAccepted)
+	}
+
+	if wait := e.reserveMinInterval(target, time.Now()); wait > 0 {
+		e.approvals.put(d)
+		return e.rejectTooRecent(ctx, target, wait)
+	}
+
+	log.Infow("Pending deployment approved", "audit", true, "id", d.ID, "service", d.Target, "image", d.Image, "requestedBy", d.RequestedBy, "approvedBy", ctx.identity, "requestId", ctx.id)
+	go e.redeploy(deployCtx, target, d.Image)
+
+	return ctx.sendJSON(ResponseMessage{
+		Message: "Redeployment approved",
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedeploy_requiresApproval(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+	approverToken := "8e0c9d1f0a6b4c7e9f2d3a5b6c7d8e9f"
+	approverSalt := "b2a4a0a1e2f34c9d8e7f6a5b4c3d2e1f"
+
+	approverHash, err := deriveKey(approverToken, scryptKey{N: 16384, r: 8, p: 1, keyLen: 32, salt: approverSalt})
+	assert.NoError(err)
+
+	reg := newTestRegistry()
+	defer reg.server.Close()
+	m := manifest{MediaType: mediaTypeOCIManifest}
+	reg.addManifest("repository/svc", "1.1", m)
+	reg.addManifest("repository/svc", "1.2", manifest{MediaType: mediaTypeOCIManifest, Layers: []descriptor{{Digest: "sha256:abc"}}})
+	raw, _ := json.Marshal(m)
+	image := reg.host() + "/repository/svc:1.1"
+	pinned := fmt.Sprintf("%s@sha256:%x", image, sha256.Sum256(raw))
+
+	dc := &mockDockerClient{
+		GetImageIDOutput: "repository/svc:1.0",
+	}
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			Credentials: map[string]AuthKey{
+				"approver": {
+					Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=" + approverHash,
+					Salt: approverSalt,
+				},
+			},
+			Services: map[string]Target{
+				"test-svc": Target{
+					ID:               "test-svc",
+					Binary:           "/bin/sh",
+					Script:           "./resources/test-svc.sh",
+					MustMatch:        "/repository/svc:.*",
+					RequiresApproval: true,
+				},
+			},
+		},
+		docker:    dc,
+		registry:  reg.client(),
+		approvals: newApprovalStore(),
+	}
+	server := newServer(e, 9000)
+
+	req := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  image,
+	})
+	req.Header.Set(tokenHeader, deployToken)
+	req.Header.Set(requestIDHeader, "client-chosen-id")
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusAccepted, res.Code)
+
+	var pending PendingDeployment
+	err = json.Unmarshal(res.Body.Bytes(), &pending)
+	assert.NoError(err)
+	assert.NotEmpty(pending.ID)
+	assert.NotEqual("client-chosen-id", pending.ID)
+	assert.Equal(defaultCredential, pending.RequestedBy)
+	assert.Equal(pinned, pending.Image)
+
+	reqOther := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  reg.host() + "/repository/svc:1.2",
+	})
+	reqOther.Header.Set(tokenHeader, deployToken)
+	reqOther.Header.Set(requestIDHeader, "client-chosen-id")
+	resOther := performTestRequest(server.Handler, reqOther)
+	assert.Equal(http.StatusAccepted, resOther.Code)
+
+	var other PendingDeployment
+	err = json.Unmarshal(resOther.Body.Bytes(), &other)
+	assert.NoError(err)
+	assert.NotEqual(pending.ID, other.ID)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal("", dc.PullArg)
+
+	reqSelf := createTestRequest("/deployments/"+pending.ID+"/approve", http.MethodPost, nil)
+	reqSelf.Header.Set(tokenHeader, deployToken)
+	resSelf := performTestRequest(server.Handler, reqSelf)
+	assert.Equal(http.StatusForbidden, resSelf.Code)
+
+	reqUnknown := createTestRequest("/deployments/unknown/approve", http.MethodPost, nil)
+	reqUnknown.Header.Set(tokenHeader, approverToken)
+	resUnknown := performTestRequest(server.Handler, reqUnknown)
+	assert.Equal(http.StatusNotFound, resUnknown.Code)
+
+	reqNoImage := createTestRequest("/deployments/"+pending.ID+"/approve", http.MethodPost, ReviewRequest{})
+	reqNoImage.Header.Set(tokenHeader, approverToken)
+	resNoImage := performTestRequest(server.Handler, reqNoImage)
+	assert.Equal(http.StatusConflict, resNoImage.Code)
+
+	reqMismatch := createTestRequest("/deployments/"+pending.ID+"/approve", http.MethodPost, ReviewRequest{Image: other.Image})
+	reqMismatch.Header.Set(tokenHeader, approverToken)
+	resMismatch := performTestRequest(server.Handler, reqMismatch)
+	assert.Equal(http.StatusConflict, resMismatch.Code)
+
+	reqApprove := createTestRequest("/deployments/"+pending.ID+"/approve", http.MethodPost, ReviewRequest{Image: pinned})
+	reqApprove.Header.Set(tokenHeader, approverToken)
+	resApprove := performTestRequest(server.Handler, reqApprove)
+	assert.Equal(http.StatusOK, resApprove.Code)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(pinned, dc.PullArg)
+
+	reqTwice := createTestRequest("/deployments/"+pending.ID+"/approve", http.MethodPost, ReviewRequest{Image: pinned})
+	reqTwice.Header.Set(tokenHeader, approverToken)
+	resTwice := performTestRequest(server.Handler, reqTwice)
+	assert.Equal(http.StatusNotFound, resTwice.Code)
+}
+
+func TestRedeploy_approvalRechecksTarget(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+	approverToken := "8e0c9d1f0a6b4c7e9f2d3a5b6c7d8e9f"
+	approverSalt := "b2a4a0a1e2f34c9d8e7f6a5b4c3d2e1f"
+
+	approverHash, err := deriveKey(approverToken, scryptKey{N: 16384, r: 8, p: 1, keyLen: 32, salt: approverSalt})
+	assert.NoError(err)
+
+	reg := newTestRegistry()
+	defer reg.server.Close()
+	m := manifest{MediaType: mediaTypeOCIManifest}
+	reg.addManifest("repository/svc", "1.1", m)
+	raw, _ := json.Marshal(m)
+	image := reg.host() + "/repository/svc:1.1"
+	pinned := fmt.Sprintf("%s@sha256:%x", image, sha256.Sum256(raw))
+
+	dc := &mockDockerClient{
+		GetImageIDOutput: "repository/svc:1.0",
+	}
+	target := Target{
+		ID:               "test-svc",
+		Binary:           "/bin/sh",
+		Script:           "./resources/test-svc.sh",
+		MustMatch:        "/repository/svc:.*",
+		RequiresApproval: true,
+	}
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			Credentials: map[string]AuthKey{
+				"approver": {
+					Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=" + approverHash,
+					Salt: approverSalt,
+				},
+			},
+			FreezeOverrideIdentities: []string{defaultCredential},
+			Services: map[string]Target{
+				"test-svc": target,
+			},
+		},
+		docker:    dc,
+		registry:  reg.client(),
+		approvals: newApprovalStore(),
+	}
+	server := newServer(e, 9000)
+
+	requestApproval := func(req RedeploymentRequest) PendingDeployment {
+		httpReq := createTestRequest("/redeploy", http.MethodPost, req)
+		httpReq.Header.Set(tokenHeader, deployToken)
+		res := performTestRequest(server.Handler, httpReq)
+		assert.Equal(http.StatusAccepted, res.Code)
+
+		var pending PendingDeployment
+		assert.NoError(json.Unmarshal(res.Body.Bytes(), &pending))
+		return pending
+	}
+	approve := func(pending PendingDeployment) int {
+		req := createTestRequest("/deployments/"+pending.ID+"/approve", http.MethodPost, ReviewRequest{Image: pending.Image})
+		req.Header.Set(tokenHeader, approverToken)
+		return performTestRequest(server.Handler, req).Code
+	}
+
+	queued := requestApproval(RedeploymentRequest{Target: "test-svc", Image: image})
+	changed := requestApproval(RedeploymentRequest{Target: "test-svc", Image: image})
+
+	target.MustMatch = "^other/svc:.*"
+	e.cfg.Services["test-svc"] = target
+	assert.Equal(http.StatusForbidden, approve(changed))
+	target.MustMatch = "/repository/svc:.*"
+	e.cfg.Services["test-svc"] = target
+
+	e.cfg.Freeze = []FreezeWindow{{Name: "forever", From: "2000-01-01", Until: "2999-12-31"}}
+	assert.Equal(http.StatusForbidden, approve(queued))
+
+	e.cfg.Freeze[0].Action = freezeQueue
+	assert.Equal(http.StatusAccepted, approve(queued))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal("", dc.PullArg)
+	e.mu.Lock()
+	assert.Equal(pinned, e.queued["test-svc"].image)
+	e.mu.Unlock()
+
+	e.cfg.Freeze[0].Action = freezeReject
+	override := requestApproval(RedeploymentRequest{Target: "test-svc", Image: image, Override: true, Reason: "hotfix for outage"})
+	assert.Equal(http.StatusForbidden, approve(changed))
+	assert.Equal(http.StatusOK, approve(override))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(pinned, dc.PullArg)
+}
+
+func TestRedeploy_approvalSystemd(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			Services: map[string]Target{
+				"test-svc": Target{
+					ID:               "test-svc",
+					Type:             typeSystemd,
+					MustMatch:        `^1\.\d+\.\d+$`,
+					RequiresApproval: true,
+					Systemd:          &Systemd{Unit: "test-svc.service"},
+				},
+			},
+		},
+		docker:    &mockDockerClient{},
+		approvals: newApprovalStore(),
+	}
+	server := newServer(e, 9000)
+
+	req := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "1.4.0",
+	})
+	req.Header.Set(tokenHeader, deployToken)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusAccepted, res.Code)
+
+	var pending PendingDeployment
+	err := json.Unmarshal(res.Body.Bytes(), &pending)
+	assert.NoError(err)
+	assert.Equal("1.4.0", pending.Image)
+}
+
+func TestApprovalStore(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newApprovalStore()
+	assert.NoError(store.add(&PendingDeployment{ID: "expired", Expires: time.Now().Add(-time.Second)}))
+	assert.NoError(store.add(&PendingDeployment{ID: "pending", Expires: time.Now().Add(time.Hour)}))
+	assert.Equal(errDuplicateApproval, store.add(&PendingDeployment{ID: "pending", Image: "other", Expires: time.Now().Add(time.Hour)}))
+
+	_, ok := store.take("expired")
+	assert.False(ok)
+
+	d, ok := store.take("pending")
+	assert.True(ok)
+	assert.Equal("pending", d.ID)
+
+	_, ok = store.take("pending")
+	assert.False(ok)
+
+	ctx := newTestContext()
+	ctx.identity = "ci"
+	ctx.approver = "release-manager"
+	job := newJob(ctx, Target{ID: "test-svc"}, "repository/svc:1.1")
+	assert.Equal("ci", job.TriggeredBy)
+	assert.Equal("release-manager", job.ApprovedBy)
+}
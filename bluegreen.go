@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Deployment modes.
+const (
+	modeRecreate  = "recreate"
+	modeBlueGreen = "bluegreen"
+)
+
+const (
+	colorBlue  = "blue"
+	colorGreen = "green"
+
+	defaultHealthTimeout = 60 * time.Second
+	defaultDrainTimeout  = 30 * time.Second
+	healthCheckInterval  = time.Second
+)
+
+var (
+	errUnhealthy      = fmt.Errorf("Container did not become healthy")
+	errNoActiveTarget = fmt.Errorf("No active deployment")
+)
+
+// BlueGreen configures zero downtime deployments where redeployer proxies traffic
+// to one of two containers, named <id>-blue and <id>-green, listening on
+// separate host ports. The container port is only used with a container spec.
+// The active color is saved to the state file so that it survives restarts of
+// redeployer. It should be in a directory only writable by redeployer.
+type BlueGreen struct {
+	Listen        string        `yaml:"listen,omitempty"`
+	BluePort      int           `yaml:"bluePort,omitempty"`
+	GreenPort     int           `yaml:"greenPort,omitempty"`
+	ContainerPort int           `yaml:"containerPort,omitempty"`
+	HealthPath    string        `yaml:"healthPath,omitempty"`
+	HealthTimeout time.Duration `yaml:"healthTimeout,omitempty"`
+	DrainTimeout  time.Duration `yaml:"drainTimeout,omitempty"`
+	StateFile     string        `yaml:"stateFile,omitempty"`
+}
+
+func (bg BlueGreen) validate() error {
+	if bg.Listen == "" || bg.BluePort == 0 || bg.GreenPort == 0 || bg.BluePort == bg.GreenPort {
+		return fmt.Errorf("blue/green mode requires listen as well as distinct blue and green ports")
+	}
+	if bg.StateFile == "" {
+		return fmt.Errorf("blue/green mode requires a stateFile")
+	}
+	return nil
+}
+
+func (bg BlueGreen) port(color string) int {
+	if color == colorGreen {
+		return bg.GreenPort
+	}
+	return bg.BluePort
+}
+
+// backend one of the two containers a blueGreenProxy can route traffic to.
+type backend struct {
+	color    string
+	name     string
+	proxy    *httputil.ReverseProxy
+	inflight int64
+}
+
+func newBackend(targetID, color string, port int) *backend {
+	upstream := &url.URL{
+		Scheme: "http",
+		Host:   "127.0.0.1:" + strconv.Itoa(port),
+	}
+
+	return &backend{
+		color: color,
+		name:  targetID + "-" + color,
+		proxy: httputil.NewSingleHostReverseProxy(upstream),
+	}
+}
+
+// blueGreenProxy reverse proxy in front of a blue/green target. The active
+// backend is swapped atomically when a new deployment has become healthy.
+type blueGreenProxy struct {
+	cfg    BlueGreen
+	target string
+	active atomic.Value
+	mu     sync.Mutex
+}
+
+func newBlueGreenProxy(target Target) *blueGreenProxy {
+	return &blueGreenProxy{
+		cfg:    *target.BlueGreen,
+		target: target.ID,
+	}
+}
+
+func (p *blueGreenProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b := p.current()
+	if b == nil {
+		http.Error(w, errNoActiveTarget.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	atomic.AddInt64(&b.inflight, 1)
+	defer atomic.AddInt64(&b.inflight, -1)
+	b.proxy.ServeHTTP(w, r)
+}
+
+func (p *blueGreenProxy) listen() {
+	log.Infow("Starting blue/green proxy", "service", p.target, "listen", p.cfg.Listen)
+	err := http.ListenAndServe(p.cfg.Listen, p)
+	if err != nil {
+		log.Errorw("Blue/green proxy failed", "service", p.target, "error", err)
+	}
+}
+
+func (p *blueGreenProxy) current() *backend {
+	b, _ := p.active.Load().(*backend)
+	return b
+}
+
+// activate routes traffic to a color and saves it as the active one.
+func (p *blueGreenProxy) activate(color string) {
+	p.active.Store(newBackend(p.target, color, p.cfg.port(color)))
+
+	err := writeFileAtomic(p.cfg.StateFile, []byte(color), 0600)
+	if err != nil {
+		log.Warnw("Failed to save blue/green state", "service", p.target, "error", err)
+	}
+}
+
+// next returns the color that the next deployment should use.
+func (p *blueGreenProxy) next() string {
+	if b := p.current(); b != nil && b.color == colorBlue {
+		return colorGreen
+	}
+	return colorBlue
+}
+
+// drain waits for in flight requests to an inactive backend to complete.
+func (p *blueGreenProxy) drain(b *backend) bool {
+	timeout := p.cfg.DrainTimeout
+	if timeout == 0 {
+		timeout = defaultDrainTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&b.inflight) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return true
+}
+
+// restore determines which color is live from the saved state, provided that its
+// container is running. Otherwise the running container is used, and if both
+// colors are running the one started last.
+func (p *blueGreenProxy) restore(ctx *Context, docker DockerClient) {
+	running := make(map[string]time.Time)
+	for _, color := range []string{colorBlue, colorGreen} {
+		started, ok := runningSince(ctx, docker, p.target+"-"+color)
+		if ok {
+			running[color] = started
+		}
+	}
+
+	saved, err := ioutil.ReadFile(p.cfg.StateFile)
+	color := strings.TrimSpace(string(saved))
+	if _, ok := running[color]; err != nil || !ok {
+		color = ""
+		for c, started := range running {
+			if color == "" || started.After(running[color]) {
+				color = c
+			}
+		}
+
+		if len(running) > 1 {
+			log.Warnw("No saved blue/green state, using the last started color", "service", p.target, "active", color)
+		}
+	}
+
+	if color == "" {
+		return
+	}
+
+	p.activate(color)
+	log.Infow("Restored blue/green state", "service", p.target, "active", color)
+}
+
+// runningSince returns when a container was started if it is running.
+func runningSince(ctx *Context, docker DockerClient, name string) (time.Time, bool) {
+	raw, err := docker.InspectContainer(ctx, name)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var inspect struct {
+		State struct {
+			Running   bool      `json:"Running"`
+			StartedAt time.Time `json:"StartedAt"`
+		} `json:"State"`
+	}
+	err = json.Unmarshal(raw, &inspect)
+	if err != nil || !inspect.State.Running {
+		return time.Time{}, false
+	}
+
+	return inspect.State.StartedAt, true
+}
+
+func (e *env) redeployBlueGreen(ctx *Context, target Target, job *Job) {
+	proxy, ok := e.proxies[target.ID]
+	if !ok {
+		job.fail(errInternalError)
+		log.Errorw("No proxy for blue/green target", "service", target.ID, "requestId", ctx.id)
+		return
+	}
+
+	// Only one deployment at a time can decide which color is free.
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	err := e.pullImage(ctx, target, job)
+	if err == nil {
+		err = e.runOneOffs(ctx, target, job)
+	}
+	if err != nil {
+		job.fail(err)
+		log.Errorw("Redeployment aborted", "error", err, "requestId", ctx.id)
+		return
+	}
+
+	old := proxy.current()
+	if old != nil {
+		job.Previous, _ = e.docker.GetImageID(ctx, old.name)
+	}
+
+	color := proxy.next()
+	next := newBackend(target.ID, color, proxy.cfg.port(color))
+	e.removeIfExists(ctx, next.name)
+
+	hostPort := strconv.Itoa(proxy.cfg.port(color))
+	if target.Container != nil {
+		spec := target.Container.withPort(fmt.Sprintf("127.0.0.1:%s:%d", hostPort, proxy.cfg.ContainerPort))
+		target.Container = &spec
+	}
+
+	env := []string{
+		"REDEPLOYER_CONTAINER_NAME=" + next.name,
+		"REDEPLOYER_HOST_PORT=" + hostPort,
+	}
+	output, err := e.startTarget(ctx, target, job, next.name, env)
+	job.setOutput(output)
+	log.Infow(output, "requestId", ctx.id)
+	if err != nil {
+		job.fail(err)
+		log.Errorw("Failed to execute redeployment", "error", err, "output", output, "requestId", ctx.id)
+		e.captureDiagnostics(ctx, target, job, next.name)
+		e.removeIfExists(ctx, next.name)
+		return
+	}
+
+	err = proxy.waitHealthy(ctx, color)
+	if err != nil {
+		job.fail(err)
+		log.Errorw("New deployment is unhealthy, keeping current", "container", next.name, "requestId", ctx.id)
+		e.captureDiagnostics(ctx, target, job, next.name)
+		e.removeIfExists(ctx, next.name)
+		return
+	}
+
+	err = e.runProbesOn(ctx, target, job, next.name, map[string]string{
+		"REDEPLOYER_CONTAINER_NAME": next.name,
+		"REDEPLOYER_HOST_PORT":      hostPort,
+	})
+	if err != nil {
+		job.fail(err)
+		log.Errorw("New deployment failed probes, keeping current", "container", next.name, "requestId", ctx.id)
+		e.captureDiagnostics(ctx, target, job, next.name)
+		e.removeIfExists(ctx, next.name)
+		return
+	}
+
+	proxy.activate(color)
+	log.Infow("Switched traffic", "service", target.ID, "active", color, "requestId", ctx.id)
+	if old == nil {
+		return
+	}
+
+	if !proxy.drain(old) {
+		log.Warnw("Timed out draining connections", "container", old.name, "requestId", ctx.id)
+	}
+
+	err = e.docker.RemoveContainer(ctx, old.name)
+	if err == nil && job.Previous != "" && job.Previous != job.Image && target.Retention == nil {
+		e.docker.RemoveImage(ctx, job.Previous)
+	}
+}
+
+// waitHealthy polls the health endpoint of a backend until it responds with a
+// successful status, the health timeout is exceeded or the context is done.
+func (p *blueGreenProxy) waitHealthy(ctx *Context, color string) error {
+	timeout := p.cfg.HealthTimeout
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+
+	u := fmt.Sprintf("http://127.0.0.1:%d%s", p.cfg.port(color), p.cfg.HealthPath)
+	client := &http.Client{Timeout: healthCheckInterval}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+
+		res, err := client.Do(req.WithContext(ctx))
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode >= 200 && res.StatusCode < 300 {
+				return nil
+			}
+		}
+
+		log.Debugw("Waiting for container to become healthy", "url", u, "requestId", ctx.id)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(healthCheckInterval):
+		}
+	}
+
+	return errUnhealthy
+}
+
+// containerName returns the name of the container currently running a target.
+func (e *env) containerName(target Target) string {
+	if target.Mode != modeBlueGreen {
+		return target.ID
+	}
+
+	if proxy, ok := e.proxies[target.ID]; ok {
+		if b := proxy.current(); b != nil {
+			return b.name
+		}
+	}
+	return target.ID
+}
+
+func (e *env) removeIfExists(ctx *Context, name string) {
+	removeIfExists(ctx, e.docker, name)
+}
+
+// removeIfExists removes a container unless there is no container by the name.
+func removeIfExists(ctx *Context, docker DockerClient, name string) {
+	_, err := docker.GetImageID(ctx, name)
+	if err == nil {
+		docker.RemoveContainer(ctx, name)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedeployBlueGreen(t *testing.T) {
+	assert := assert.New(t)
+
+	blue, bluePort := newTestUpstream("blue")
+	defer blue.Close()
+	green, greenPort := newTestUpstream("green")
+	defer green.Close()
+
+	dir, err := ioutil.TempDir("", "redeployer-bluegreen")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	target := Target{
+		ID:     "test-svc",
+		Binary: "/bin/sh",
+		Script: "./resources/test-svc.sh",
+		Mode:   modeBlueGreen,
+		BlueGreen: &BlueGreen{
+			Listen:        ":0",
+			BluePort:      bluePort,
+			GreenPort:     greenPort,
+			HealthPath:    "/health",
+			HealthTimeout: 2 * time.Second,
+			DrainTimeout:  time.Second,
+			StateFile:     filepath.Join(dir, "test-svc.color"),
+		},
+	}
+	proxy := newBlueGreenProxy(target)
+	dc := &mockDockerClient{
+		GetImageIDOutput: "repository/svc:1.0",
+	}
+	e := &env{
+		docker:  dc,
+		proxies: map[string]*blueGreenProxy{target.ID: proxy},
+	}
+
+	res := performTestRequest(proxy, createTestRequest("/", http.MethodGet, nil))
+	assert.Equal(http.StatusServiceUnavailable, res.Code)
+
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	e.redeployBlueGreen(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Equal("", job.Previous)
+	assert.Equal("test-svc", e.containerName(Target{ID: "test-svc"}))
+	assert.Equal("test-svc-blue", e.containerName(target))
+	assert.Equal("blue", proxyBody(proxy))
+
+	dc.Reset()
+	dc.GetImageIDOutput = "repository/svc:1.1"
+	job = newJob(newTestContext(), target, "repository/svc:1.2")
+	e.redeployBlueGreen(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Equal("repository/svc:1.1", job.Previous)
+	assert.Equal("green", proxyBody(proxy))
+	assert.Equal("test-svc-blue", dc.RemoveContainerArg)
+	assert.Equal("repository/svc:1.1", dc.RemoveImageArg)
+
+	target.BlueGreen.HealthPath = "/unhealthy"
+	proxy.cfg.HealthPath = "/unhealthy"
+	dc.Reset()
+	dc.GetImageIDOutput = "repository/svc:1.2"
+	job = newJob(newTestContext(), target, "repository/svc:1.3")
+	e.redeployBlueGreen(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal(errUnhealthy.Error(), job.Error)
+	assert.Equal("green", proxyBody(proxy))
+	assert.Equal("test-svc-blue", dc.RemoveContainerArg)
+	assert.Equal("", dc.RemoveImageArg)
+
+	target.BlueGreen.HealthPath = "/health"
+	proxy.cfg.HealthPath = "/health"
+	target.Probes = []Probe{{
+		Type:     probeHTTP,
+		URL:      "http://127.0.0.1:${REDEPLOYER_HOST_PORT}/unhealthy",
+		Interval: 10 * time.Millisecond,
+		Retries:  1,
+	}}
+	dc.Reset()
+	dc.GetImageIDOutput = "repository/svc:1.2"
+	job = newJob(newTestContext(), target, "repository/svc:1.3")
+	e.redeployBlueGreen(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Len(job.Probes, 1)
+	assert.Equal("http http://127.0.0.1:"+strconv.Itoa(bluePort)+"/unhealthy", job.Probes[0].Probe)
+	assert.Equal("green", proxyBody(proxy))
+	assert.Equal("test-svc-blue", dc.RemoveContainerArg)
+
+	target.Probes[0].URL = "http://127.0.0.1:${REDEPLOYER_HOST_PORT}/"
+	dc.Reset()
+	dc.GetImageIDOutput = "repository/svc:1.2"
+	job = newJob(newTestContext(), target, "repository/svc:1.3")
+	e.redeployBlueGreen(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.True(job.Probes[0].Passed)
+	assert.Equal("blue", proxyBody(proxy))
+}
+
+func TestBlueGreenRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "redeployer-bluegreen")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	target := Target{
+		ID:   "test-svc",
+		Mode: modeBlueGreen,
+		BlueGreen: &BlueGreen{
+			Listen:    ":0",
+			BluePort:  9001,
+			GreenPort: 9002,
+			StateFile: filepath.Join(dir, "test-svc.color"),
+		},
+	}
+	dc := &inspectingDockerClient{
+		containers: map[string]string{
+			"test-svc-blue":  `{"State": {"Running": false, "StartedAt": "2026-10-18T10:00:00Z"}}`,
+			"test-svc-green": `{"State": {"Running": true, "StartedAt": "2026-10-18T09:00:00Z"}}`,
+		},
+	}
+
+	proxy := newBlueGreenProxy(target)
+	proxy.restore(newTestContext(), dc)
+	assert.Equal(colorGreen, proxy.current().color)
+
+	dc.containers["test-svc-blue"] = `{"State": {"Running": true, "StartedAt": "2026-10-18T10:00:00Z"}}`
+	proxy = newBlueGreenProxy(target)
+	proxy.restore(newTestContext(), dc)
+	assert.Equal(colorGreen, proxy.current().color)
+
+	assert.NoError(os.Remove(target.BlueGreen.StateFile))
+	proxy = newBlueGreenProxy(target)
+	proxy.restore(newTestContext(), dc)
+	assert.Equal(colorBlue, proxy.current().color)
+
+	saved, err := ioutil.ReadFile(target.BlueGreen.StateFile)
+	assert.NoError(err)
+	assert.Equal(colorBlue, string(saved))
+
+	delete(dc.containers, "test-svc-blue")
+	delete(dc.containers, "test-svc-green")
+	proxy = newBlueGreenProxy(target)
+	proxy.restore(newTestContext(), dc)
+	assert.Nil(proxy.current())
+}
+
+func TestWaitHealthy_cancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream, port := newTestUpstream("blue")
+	defer upstream.Close()
+
+	proxy := newBlueGreenProxy(Target{
+		ID: "test-svc",
+		BlueGreen: &BlueGreen{
+			BluePort:      port,
+			HealthPath:    "/unhealthy",
+			HealthTimeout: time.Minute,
+		},
+	})
+
+	ctx, cancel := newTestContext().withTimeout(100 * time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := proxy.waitHealthy(ctx, colorBlue)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+// inspectingDockerClient mock docker client returning the inspect output of
+// containers by name.
+type inspectingDockerClient struct {
+	mockDockerClient
+	containers map[string]string
+}
+
+func (c *inspectingDockerClient) InspectContainer(ctx *Context, name string) (json.RawMessage, error) {
+	raw, ok := c.containers[name]
+	if !ok {
+		return nil, errNoSuchContainer
+	}
+	return json.RawMessage(raw), nil
+}
+
+func newTestUpstream(name string) (*httptest.Server, int) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unhealthy":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(name))
+		}
+	}))
+
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return server, port
+}
+
+func proxyBody(proxy http.Handler) string {
+	res := performTestRequest(proxy, createTestRequest("/", http.MethodGet, nil))
+	body, _ := ioutil.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestBlueGreenStateFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "redeployer-bluegreen")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cfg := BlueGreen{Listen: ":0", BluePort: 8081, GreenPort: 8082}
+	assert.Error(cfg.validate())
+	cfg.StateFile = filepath.Join(dir, "test-svc.color")
+	assert.NoError(cfg.validate())
+
+	victim := filepath.Join(dir, "victim")
+	assert.NoError(ioutil.WriteFile(victim, []byte("untouched"), 0644))
+	assert.NoError(os.Symlink(victim, cfg.StateFile))
+
+	proxy := newBlueGreenProxy(Target{ID: "test-svc", BlueGreen: &cfg})
+	proxy.activate(colorGreen)
+
+	content, err := ioutil.ReadFile(victim)
+	assert.NoError(err)
+	assert.Equal("untouched", string(content))
+
+	info, err := os.Lstat(cfg.StateFile)
+	assert.NoError(err)
+	assert.True(info.Mode().IsRegular())
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	content, err = ioutil.ReadFile(cfg.StateFile)
+	assert.NoError(err)
+	assert.Equal(colorGreen, string(content))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxFailures   = 10
+	defaultFailureWindow = 15 * time.Minute
+	defaultLockout       = 15 * time.Minute
+	defaultFailureDelay  = 250 * time.Millisecond
+	defaultMaxDelay      = 5 * time.Second
+	authQueueTimeout     = 5 * time.Second
+	maxTrackedClients    = 10000
+)
+
+var errServiceUnavailable = fmt.Errorf("Service unavailable") // 503
+
+// AuthProtection configures protection of token authentication against brute
+// force attempts. Each consecutive failure from an IP within the failure window
+// is answered after a doubling delay, and after maxFailures the IP is locked
+// out. At most maxConcurrent keys are derived at the same time.
+type AuthProtection struct {
+	MaxFailures   int           `yaml:"maxFailures,omitempty"`
+	FailureWindow time.Duration `yaml:"failureWindow,omitempty"`
+	Lockout       time.Duration `yaml:"lockout,omitempty"`
+	Delay         time.Duration `yaml:"delay,omitempty"`
+	MaxDelay      time.Duration `yaml:"maxDelay,omitempty"`
+	MaxConcurrent int           `yaml:"maxConcurrent,omitempty"`
+}
+
+func (p *AuthProtection) withDefaults() AuthProtection {
+	var cfg AuthProtection
+	if p != nil {
+		cfg = *p
+	}
+
+	if cfg.MaxFailures == 0 {
+		cfg.MaxFailures = defaultMaxFailures
+	}
+	if cfg.FailureWindow == 0 {
+		cfg.FailureWindow = defaultFailureWindow
+	}
+	if cfg.Lockout == 0 {
+		cfg.Lockout = defaultLockout
+	}
+	if cfg.Delay == 0 {
+		cfg.Delay = defaultFailureDelay
+	}
+	if cfg.MaxDelay == 0 {
+		cfg.MaxDelay = defaultMaxDelay
+	}
+	if cfg.MaxConcurrent == 0 {
+		cfg.MaxConcurrent = runtime.NumCPU()
+	}
+
+	return cfg
+}
+
+type authFailures struct {
+	count       int
+	inFlight    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// authGuard tracks failed authentication attempts by IP and limits concurrent
+// key derivations.
+type authGuard struct {
+	cfg     AuthProtection
+	mu      sync.Mutex
+	clients map[string]*authFailures
+	slots   chan struct{}
+}
+
+func newAuthGuard(cfg *AuthProtection) *authGuard {
+	protection := cfg.withDefaults()
+	return &authGuard{
+		cfg:     protection,
+		clients: make(map[string]*authFailures),
+		slots:   make(chan struct{}, protection.MaxConcurrent),
+	}
+}
+
+// lockedOut returns how long an IP remains locked out, or 0 if it is not.
+func (g *authGuard) lockedOut(ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	f, ok := g.clients[ip]
+	if !ok || !now.Before(f.lockedUntil) {
+		return 0
+	}
+	return f.lockedUntil.Sub(now)
+}
+
+// begin records an authentication attempt from an IP and returns a function
+// which ends it, once its outcome has been recorded. Attempts still in flight
+// count towards the failures of the IP, so parallel requests cannot make more
+// attempts than a lockout allows. It returns how long to wait before retrying
+// if the attempt is not allowed.
+func (g *authGuard) begin(ip string, now time.Time) (time.Duration, func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.prune(now)
+	f, ok := g.clients[ip]
+	if ok && now.Before(f.lockedUntil) {
+		return f.lockedUntil.Sub(now), nil
+	}
+	if !ok {
+		if len(g.clients) >= maxTrackedClients {
+			g.evictOldest()
+		}
+		f = &authFailures{}
+		g.clients[ip] = f
+	}
+	if now.Sub(f.last) > g.cfg.FailureWindow {
+		f.count = 0
+	}
+	if f.count+f.inFlight >= g.cfg.MaxFailures {
+		return g.cfg.MaxDelay, nil
+	}
+
+	f.inFlight++
+	ended := false
+	return 0, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if ended {
+			return
+		}
+		ended = true
+		f.inFlight--
+		if f.inFlight == 0 && f.count == 0 && f.lockedUntil.IsZero() && g.clients[ip] == f {
+			delete(g.clients, ip)
+		}
+	}
+}
+
+// fail records a failed attempt from an IP and returns how long to delay the
+// response. The first failure is not delayed, so a single mistyped token stays
+// cheap.
+func (g *authGuard) fail(ctx *Context, ip string, now time.Time) time.Duration {
+	authFailureCount.inc()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.prune(now)
+	f, ok := g.clients[ip]
+	if !ok {
+		if len(g.clients) >= maxTrackedClients {
+			g.evictOldest()
+		}
+		f = &authFailures{}
+		g.clients[ip] = f
+	}
+	if now.Sub(f.last) > g.cfg.FailureWindow {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+
+	if f.count >= g.cfg.MaxFailures {
+		f.lockedUntil = now.Add(g.cfg.Lockout)
+		f.count = 0
+		authLockouts.inc()
+		log.Warnw("Locked out client after failed authentication attempts", "audit", true, "ip", ip, "until", f.lockedUntil, "requestId", ctx.id)
+		return 0
+	}
+
+	delay := time.Duration(0)
+	if f.count > 1 {
+		delay = g.cfg.Delay
+		for i := 2; i < f.count && delay < g.cfg.MaxDelay; i++ {
+			delay *= 2
+		}
+	}
+	if delay > g.cfg.MaxDelay {
+		delay = g.cfg.MaxDelay
+	}
+	return delay
+}
+
+// succeed clears the failures of an IP.
+func (g *authGuard) succeed(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	f, ok := g.clients[ip]
+	if !ok {
+		return
+	}
+	if f.inFlight > 0 {
+		f.count = 0
+		f.lockedUntil = time.Time{}
+		return
+	}
+	delete(g.clients, ip)
+}
+
+// prune drops failures which have fallen out of the window and ended lockouts.
+func (g *authGuard) prune(now time.Time) {
+	for ip, f := range g.clients {
+		if f.inFlight == 0 && now.Sub(f.last) > g.cfg.FailureWindow && !now.Before(f.lockedUntil) {
+			delete(g.clients, ip)
+		}
+	}
+}
+
+// evictOldest drops the client whose last failure is the oldest, preferring
+// clients which are not locked out, so that failures spread over many IPs
+// cannot grow the tracked clients without bound.
+func (g *authGuard) evictOldest() {
+	var oldest string
+	var oldestFailures *authFailures
+	for ip, f := range g.clients {
+		if oldestFailures == nil || isOlderFailure(f, oldestFailures) {
+			oldest, oldestFailures = ip, f
+		}
+	}
+	delete(g.clients, oldest)
+}
+
+func isOlderFailure(a, b *authFailures) bool {
+	if a.lockedUntil.IsZero() != b.lockedUntil.IsZero() {
+		return a.lockedUntil.IsZero()
+	}
+	return a.last.Before(b.last)
+}
+
+// acquire waits for a key derivation slot. The returned function releases it.
+func (g *authGuard) acquire() (func(), error) {
+	timer := time.NewTimer(authQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case g.slots <- struct{}{}:
+		return func() { <-g.slots }, nil
+	case <-timer.C:
+		authSaturated.inc()
+		return nil, errServiceUnavailable
+	}
+}
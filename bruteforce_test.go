@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthGuard(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	guard := newAuthGuard(&AuthProtection{MaxFailures: 5, Delay: time.Second, MaxDelay: 3 * time.Second, MaxConcurrent: 1})
+	ctx := newTestContext()
+
+	assert.Equal(time.Duration(0), guard.fail(ctx, "10.0.0.1", now))
+	assert.Equal(time.Second, guard.fail(ctx, "10.0.0.1", now))
+	assert.Equal(2*time.Second, guard.fail(ctx, "10.0.0.1", now))
+	assert.Equal(3*time.Second, guard.fail(ctx, "10.0.0.1", now))
+	assert.Equal(time.Duration(0), guard.lockedOut("10.0.0.1", now))
+
+	lockouts := authLockouts.get()
+	guard.fail(ctx, "10.0.0.1", now)
+	assert.Equal(lockouts+1, authLockouts.get())
+	assert.Equal(defaultLockout, guard.lockedOut("10.0.0.1", now))
+	assert.Equal(time.Duration(0), guard.lockedOut("10.0.0.2", now))
+	assert.Equal(time.Duration(0), guard.lockedOut("10.0.0.1", now.Add(defaultLockout)))
+
+	guard.fail(ctx, "10.0.0.2", now)
+	assert.Equal(time.Duration(0), guard.fail(ctx, "10.0.0.2", now.Add(defaultFailureWindow+time.Second)))
+	guard.succeed("10.0.0.2")
+	assert.Equal(time.Duration(0), guard.fail(ctx, "10.0.0.2", now))
+
+	release, err := guard.acquire()
+	assert.NoError(err)
+	done := make(chan struct{})
+	go func() {
+		r, err := guard.acquire()
+		assert.NoError(err)
+		r()
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release()
+	<-done
+}
+
+func TestAuthGuard_inFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	guard := newAuthGuard(&AuthProtection{MaxFailures: 2, MaxDelay: 3 * time.Second})
+	ctx := newTestContext()
+
+	wait, end1 := guard.begin("10.0.0.1", now)
+	assert.Equal(time.Duration(0), wait)
+	wait, end2 := guard.begin("10.0.0.1", now)
+	assert.Equal(time.Duration(0), wait)
+	wait, _ = guard.begin("10.0.0.1", now)
+	assert.Equal(3*time.Second, wait)
+	wait, end3 := guard.begin("10.0.0.2", now)
+	assert.Equal(time.Duration(0), wait)
+	end3()
+
+	guard.fail(ctx, "10.0.0.1", now)
+	end1()
+	end1()
+	wait, _ = guard.begin("10.0.0.1", now)
+	assert.Equal(3*time.Second, wait)
+
+	guard.fail(ctx, "10.0.0.1", now)
+	end2()
+	wait, _ = guard.begin("10.0.0.1", now)
+	assert.Equal(defaultLockout, wait)
+
+	wait, end3 = guard.begin("10.0.0.2", now)
+	assert.Equal(time.Duration(0), wait)
+	guard.succeed("10.0.0.2")
+	end3()
+	guard.mu.Lock()
+	assert.Len(guard.clients, 1)
+	guard.mu.Unlock()
+}
+
+func TestHandler_lockout(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			AuthProtection: &AuthProtection{MaxFailures: 2, Delay: time.Millisecond},
+			Services: map[string]Target{
+				"test-svc": Target{
+					ID:        "test-svc",
+					Binary:    "/bin/sh",
+					Script:    "./resources/test-svc.sh",
+					MustMatch: "^repository/svc:.*",
+				},
+			},
+		},
+		docker: &mockDockerClient{},
+	}
+	server := newServer(e, 9000)
+
+	for i := 0; i < 2; i++ {
+		req := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+			Target: "test-svc",
+			Image:  "repository/svc:1.1",
+		})
+		req.Header.Set(tokenHeader, "some-wrong-token")
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusUnauthorized, res.Code)
+	}
+
+	req := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.1",
+	})
+	req.Header.Set(tokenHeader, deployToken)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusTooManyRequests, res.Code)
+	assert.Equal("900", res.Header().Get(retryAfterHeader))
+
+	reqUnauthorized := createTestRequest("/metrics", http.MethodGet, nil)
+	reqUnauthorized.RemoteAddr = "10.0.0.2:4000"
+	resUnauthorized := performTestRequest(server.Handler, reqUnauthorized)
+	assert.Equal(http.StatusUnauthorized, resUnauthorized.Code)
+
+	reqMetrics := createTestRequest("/metrics", http.MethodGet, nil)
+	reqMetrics.RemoteAddr = "10.0.0.3:4000"
+	reqMetrics.Header.Set(tokenHeader, deployToken)
+	resMetrics := performTestRequest(server.Handler, reqMetrics)
+	assert.Equal(http.StatusOK, resMetrics.Code)
+	body := resMetrics.Body.String()
+	assert.Contains(body, "# TYPE redeployer_auth_lockouts_total counter\n")
+	assert.True(strings.Contains(body, "\nredeployer_auth_locked_requests_total "))
+}
+
+func TestHandler_failureDelayCancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			AuthProtection: &AuthProtection{Delay: time.Hour, MaxDelay: time.Hour},
+		},
+		docker: &mockDockerClient{},
+	}
+	server := newServer(e, 9000)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		req := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{}).WithContext(ctx)
+		req.Header.Set(tokenHeader, "some-wrong-token")
+		res := performTestRequest(server.Handler, req)
+		cancel()
+		assert.Equal(http.StatusUnauthorized, res.Code)
+	}
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+func TestAuthGuard_bounded(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	guard := newAuthGuard(&AuthProtection{MaxFailures: 2, Lockout: time.Hour})
+	ctx := newTestContext()
+
+	guard.fail(ctx, "10.0.0.1", now)
+	guard.fail(ctx, "10.0.0.1", now)
+	guard.fail(ctx, "10.0.0.2", now)
+	assert.Len(guard.clients, 2)
+
+	guard.fail(ctx, "10.0.0.3", now.Add(defaultFailureWindow+time.Second))
+	assert.Len(guard.clients, 2)
+	assert.Contains(guard.clients, "10.0.0.1")
+	assert.NotContains(guard.clients, "10.0.0.2")
+
+	for i := 0; i < maxTrackedClients+10; i++ {
+		guard.fail(ctx, fmt.Sprintf("10.1.%d.%d", i/256, i%256), now.Add(defaultFailureWindow+time.Duration(i)*time.Millisecond))
+	}
+	assert.Len(guard.clients, maxTrackedClients)
+	assert.Contains(guard.clients, "10.0.0.1")
+	assert.NotContains(guard.clients, "10.1.0.0")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Target types.
+const (
+	typeDocker  = "docker"
+	typeCompose = "compose"
+)
+
+// Compose identifies a service in a docker compose project.
+type Compose struct {
+	File    string `yaml:"file,omitempty"`
+	Project string `yaml:"project,omitempty"`
+	Service string `yaml:"service,omitempty"`
+}
+
+func (c Compose) validate() error {
+	if c.File == "" || c.Service == "" {
+		return fmt.Errorf("compose targets require file and service")
+	}
+	return nil
+}
+
+// args returns the arguments selecting the compose project, with any additional
+// compose files applied on top of the configured one.
+func (c Compose) args(files ...string) []string {
+	args := []string{"-f", c.File}
+	for _, f := range files {
+		args = append(args, "-f", f)
+	}
+
+	if c.Project != "" {
+		args = append(args, "-p", c.Project)
+	}
+	return args
+}
+
+// ComposeImage returns the image of the running container of a compose service.
+func (c *cliDockerClient) ComposeImage(ctx *Context, cfg Compose) (string, error) {
+	log.Debugw("Retrieving compose service image", "service", cfg.Service, "requestId", ctx.id)
+	target := Target{
+		Binary: "docker",
+		Script: "compose",
+	}
+
+	args := append(cfg.args(), "ps", "-a", "--format", "{{.Image}}", cfg.Service)
+	output, err := target.execute(ctx, args...)
+	if err != nil {
+		log.Errorw("Failed to get compose service image", "output", output, "error", err, "requestId", ctx.id)
+		return "", err
+	}
+
+	lines := strings.Split(output, "\n")
+	if lines[0] == "" {
+		return "", errNoSuchContainer
+	}
+
+	return lines[0], nil
+}
+
+// ComposeUp recreates a single compose service with its image overridden.
+func (c *cliDockerClient) ComposeUp(ctx *Context, cfg Compose, image string) (string, error) {
+	log.Debugw("Recreating compose service", "service", cfg.Service, "image", image, "requestId", ctx.id)
+	override, err := writeComposeOverride(cfg.Service, image)
+	if err != nil {
+		log.Errorw("Failed to write compose override", "error", err, "requestId", ctx.id)
+		return "", err
+	}
+	defer os.Remove(override)
+
+	target := Target{
+		Binary: "docker",
+		Script: "compose",
+	}
+
+	args := append(cfg.args(override), "up", "-d", "--no-deps", "--force-recreate", cfg.Service)
+	output, err := target.execute(ctx, args...)
+	if err != nil {
+		log.Errorw("Failed to recreate compose service", "output", output, "error", err, "requestId", ctx.id)
+	}
+
+	return output, err
+}
+
+// writeComposeOverride writes a compose file that overrides the image of a service
+// and returns its path.
+func writeComposeOverride(service, image string) (string, error) {
+	content, err := yaml.Marshal(map[string]interface{}{
+		"services": map[string]interface{}{
+			service: map[string]string{
+				"image": image,
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "redeployer-compose-*.yml")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = f.Write(content)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func (e *env) redeployCompose(ctx *Context, target Target, job *Job) {
+	err := e.pullImage(ctx, target, job)
+	if err == nil {
+		err = e.runOneOffs(ctx, target, job)
+	}
+	if err != nil {
+		job.fail(err)
+		log.Errorw("Redeployment aborted", "error", err, "requestId", ctx.id)
+		return
+	}
+
+	previous, err := e.docker.ComposeImage(ctx, *target.Compose)
+	if err != nil && err != errNoSuchContainer {
+		log.Warnw("Failed to get previous compose image", "error", err, "requestId", ctx.id)
+	}
+	job.Previous = previous
+
+	output, err := e.docker.ComposeUp(ctx, *target.Compose, job.Image)
+	job.setOutput(output)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+	log.Infow(output, "requestId", ctx.id)
+
+	if previous != "" && previous != job.Image && target.Retention == nil {
+		e.docker.RemoveImage(ctx, previous)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRedeployCompose(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := Compose{
+		File:    "/srv/app/docker-compose.yml",
+		Project: "app",
+		Service: "svc",
+	}
+	target := Target{
+		ID:      "test-svc",
+		Type:    typeCompose,
+		Compose: &cfg,
+	}
+	dc := &mockDockerClient{
+		ComposeImageOutput: "repository/svc:1.0",
+	}
+	e := &env{docker: dc}
+
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	e.redeployCompose(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Equal("repository/svc:1.0", job.Previous)
+	assert.Equal("repository/svc:1.1", dc.PullArg)
+	assert.Equal(cfg, dc.ComposeImageArg)
+	assert.Equal(cfg, dc.ComposeUpArg)
+	assert.Equal("repository/svc:1.1", dc.ComposeUpImage)
+	assert.Equal("repository/svc:1.0", dc.RemoveImageArg)
+	assert.Equal("", dc.GetImageIDArg)
+	assert.Equal("", dc.RemoveContainerArg)
+
+	current, err := e.currentImage(newTestContext(), target)
+	assert.NoError(err)
+	assert.Equal("repository/svc:1.0", current)
+
+	dc.Reset()
+	dc.ComposeImageOutput = "repository/svc:1.1"
+	dc.ComposeUpErr = fmt.Errorf("exit status 1")
+	job = newJob(newTestContext(), target, "repository/svc:1.2")
+	e.redeployCompose(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal("", dc.RemoveImageArg)
+}
+
+func TestWriteComposeOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := writeComposeOverride("svc", "repository/svc:1.1")
+	assert.NoError(err)
+	defer os.Remove(path)
+
+	raw, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+
+	var override struct {
+		Services map[string]struct {
+			Image string `yaml:"image"`
+		} `yaml:"services"`
+	}
+	err = yaml.Unmarshal(raw, &override)
+	assert.NoError(err)
+	assert.Len(override.Services, 1)
+	assert.Equal("repository/svc:1.1", override.Services["svc"].Image)
+}
+
+func TestComposeArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := Compose{File: "docker-compose.yml", Service: "svc"}
+	assert.Equal([]string{"-f", "docker-compose.yml"}, cfg.args())
+
+	cfg.Project = "app"
+	assert.Equal([]string{"-f", "docker-compose.yml", "-f", "override.yml", "-p", "app"}, cfg.args("override.yml"))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ContainerSpec declarative description of how to run the container of a target,
+// used instead of a deployment script.
+type ContainerSpec struct {
+	Ports    []string          `yaml:"ports,omitempty"`
+	Env      map[string]string `yaml:"env,omitempty"`
+	Volumes  []string          `yaml:"volumes,omitempty"`
+	Networks []string          `yaml:"networks,omitempty"`
+	Labels   map[string]string `yaml:"labels,omitempty"`
+	Restart  string            `yaml:"restart,omitempty"`
+	Memory   string            `yaml:"memory,omitempty"`
+	CPUs     string            `yaml:"cpus,omitempty"`
+	Command  []string          `yaml:"command,omitempty"`
+}
+
+func (s ContainerSpec) validate() error {
+	policy := strings.SplitN(s.Restart, ":", 2)[0]
+	switch policy {
+	case "", "no", "always", "unless-stopped", "on-failure":
+	default:
+		return fmt.Errorf("invalid restart policy %q", s.Restart)
+	}
+
+	for _, v := range s.Volumes {
+		if !strings.Contains(v, ":") {
+			return fmt.Errorf("invalid volume %q", v)
+		}
+	}
+
+	return nil
+}
+
+// withPort returns a copy of the spec with an additional port mapping.
+func (s ContainerSpec) withPort(port string) ContainerSpec {
+	s.Ports = append(append([]string{}, s.Ports...), port)
+	return s
+}
+
+// runArgs returns the arguments to docker run for starting a detached container
+// from the spec. Only the first network can be set when the container is created,
+// the rest are connected afterwards.
+func (s ContainerSpec) runArgs(name, image string) []string {
+	return append([]string{"-d"}, s.createArgs(name, image)...)
+}
+
+// createArgs returns the arguments to docker run for a container from the spec
+// which runs in the foreground.
+func (s ContainerSpec) createArgs(name, image string) []string {
+	args := []string{"--name", name}
+	for _, p := range s.Ports {
+		args = append(args, "-p", p)
+	}
+	for _, k := range sortedKeys(s.Env) {
+		args = append(args, "-e", k+"="+s.Env[k])
+	}
+	for _, v := range s.Volumes {
+		args = append(args, "-v", v)
+	}
+	if len(s.Networks) > 0 {
+		args = append(args, "--network", s.Networks[0])
+	}
+	for _, k := range sortedKeys(s.Labels) {
+		args = append(args, "--label", k+"="+s.Labels[k])
+	}
+	if s.Restart != "" {
+		args = append(args, "--restart", s.Restart)
+	}
+	if s.Memory != "" {
+		args = append(args, "--memory", s.Memory)
+	}
+	if s.CPUs != "" {
+		args = append(args, "--cpus", s.CPUs)
+	}
+
+	args = append(args, image)
+	return append(args, s.Command...)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RunContainer creates and starts a named container from a container spec.
+func (c *cliDockerClient) RunContainer(ctx *Context, name, image string, spec ContainerSpec) (string, error) {
+	log.Debugw("Running container", "name", name, "image", image, "requestId", ctx.id)
+	target := Target{
+		Binary: "docker",
+		Script: "run",
+	}
+
+	output, err := target.execute(ctx, spec.runArgs(name, image)...)
+	if err != nil {
+		log.Errorw("Failed to run container", "output", output, "error", err, "requestId", ctx.id)
+		return output, err
+	}
+
+	network := Target{
+		Binary: "docker",
+		Script: "network",
+	}
+	for i := 1; i < len(spec.Networks); i++ {
+		out, err := network.execute(ctx, "connect", spec.Networks[i], name)
+		if err != nil {
+			log.Errorw("Failed to connect container to network", "network", spec.Networks[i], "output", out, "error", err, "requestId", ctx.id)
+			return output, err
+		}
+	}
+
+	return output, nil
+}
+
+// startTarget starts a container for a job, either from the container spec of the
+// target, from the configuration captured from the previous container or by
+// running its deployment script with the given extra environment. Scripts get
+// the image as their only argument, the resolved digest is passed in
+// REDEPLOYER_DIGEST since it may be empty.
+func (e *env) startTarget(ctx *Context, target Target, job *Job, name string, env []string) (string, error) {
+	if target.recreates() {
+		return e.recreateContainer(ctx, job, name, job.Image)
+	}
+
+	if target.Container == nil {
+		return target.executeWithEnv(ctx, append(job.env(), env...), job.Image)
+	}
+
+	return e.docker.RunContainer(ctx, name, job.Image, *target.Container)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerSpecRunArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := ContainerSpec{
+		Ports:    []string{"8080:8080"},
+		Env:      map[string]string{"LOG_LEVEL": "info", "DB_HOST": "db"},
+		Volumes:  []string{"data:/var/lib/svc"},
+		Networks: []string{"backend", "frontend"},
+		Labels:   map[string]string{"team": "platform"},
+		Restart:  "unless-stopped",
+		Memory:   "256m",
+		CPUs:     "0.5",
+		Command:  []string{"serve", "--verbose"},
+	}
+
+	expected := []string{
+		"-d", "--name", "test-svc",
+		"-p", "8080:8080",
+		"-e", "DB_HOST=db",
+		"-e", "LOG_LEVEL=info",
+		"-v", "data:/var/lib/svc",
+		"--network", "backend",
+		"--label", "team=platform",
+		"--restart", "unless-stopped",
+		"--memory", "256m",
+		"--cpus", "0.5",
+		"repository/svc:1.1",
+		"serve", "--verbose",
+	}
+	assert.Equal(expected, spec.runArgs("test-svc", "repository/svc:1.1"))
+	assert.Equal([]string{"-d", "--name", "svc", "svc:1"}, ContainerSpec{}.runArgs("svc", "svc:1"))
+
+	withPort := spec.withPort("127.0.0.1:9001:8080")
+	assert.Equal([]string{"8080:8080", "127.0.0.1:9001:8080"}, withPort.Ports)
+	assert.Equal([]string{"8080:8080"}, spec.Ports)
+}
+
+func TestContainerSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ContainerSpec{}.validate())
+	assert.NoError(ContainerSpec{Restart: "on-failure:3", Volumes: []string{"/data:/data:ro"}}.validate())
+	assert.Error(ContainerSpec{Restart: "sometimes"}.validate())
+	assert.Error(ContainerSpec{Volumes: []string{"/data"}}.validate())
+}
+
+func TestRedeploy_containerSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := ContainerSpec{
+		Ports:   []string{"8080:8080"},
+		Restart: "always",
+	}
+	target := Target{
+		ID:        "test-svc",
+		Container: &spec,
+	}
+	dc := &mockDockerClient{
+		GetImageIDOutput:   "repository/svc:1.0",
+		RunContainerOutput: "3f2a9c",
+	}
+	e := &env{docker: dc}
+
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	e.redeployContainer(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Equal("3f2a9c", job.Output)
+	assert.Equal("test-svc", dc.RemoveContainerArg)
+	assert.Equal("test-svc", dc.RunContainerName)
+	assert.Equal("repository/svc:1.1", dc.RunContainerImage)
+	assert.Equal(spec, dc.RunContainerSpec)
+	assert.Equal("repository/svc:1.0", dc.RemoveImageArg)
+}
+
+func TestStartTarget_scriptArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	script, err := ioutil.TempFile("", "redeployer-args-*.sh")
+	assert.NoError(err)
+	defer os.Remove(script.Name())
+	_, err = script.WriteString("echo \"$# $1 $REDEPLOYER_DIGEST\"\n")
+	assert.NoError(err)
+	script.Close()
+
+	e := &env{docker: &mockDockerClient{}}
+	target := Target{
+		ID:     "test-svc",
+		Binary: "/bin/sh",
+		Script: script.Name(),
+	}
+	ctx := &Context{id: "test-request", Context: context.Background()}
+
+	job := newJob(ctx, target, "repository/svc:1.0")
+	output, err := e.startTarget(ctx, target, job, target.ID, nil)
+	assert.NoError(err)
+	assert.Equal("1 repository/svc:1.0 ", output)
+
+	job.Digest = "sha256:4b0a2a4b3c9e3fbd1c2bd0f1d7c7e8a84cfb02e8e9bdc5a2e6d7a4ad7fbbf0c4"
+	output, err = e.startTarget(ctx, target, job, target.ID, nil)
+	assert.NoError(err)
+	assert.Equal("1 repository/svc:1.0 "+job.Digest, output)
+}
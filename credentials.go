@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	dockerHubAuthKey        = "https://index.docker.io/v1/"
+	credentialHelperTimeout = 10 * time.Second
+)
+
+// identityTokenUser username credential helpers use for identity tokens.
+const identityTokenUser = "<token>"
+
+// RegistryAuth credentials for a docker registry. Either a username and password
+// or an identity token may be set.
+type RegistryAuth struct {
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Token    string `yaml:"token,omitempty"`
+}
+
+func (a RegistryAuth) empty() bool {
+	return a.Username == "" && a.Password == "" && a.Token == ""
+}
+
+// String keeps credentials out of logs if they are ever formatted.
+func (a RegistryAuth) String() string {
+	return fmt.Sprintf("RegistryAuth{Username: %s}", a.Username)
+}
+
+// credentialStore looks up registry credentials, first in the redeployer config
+// and then in a docker config file with its credential helpers.
+type credentialStore struct {
+	registries   map[string]RegistryAuth
+	dockerConfig string
+}
+
+func newCredentialStore(cfg Config) *credentialStore {
+	for _, auth := range cfg.Registries {
+		secrets.add(auth.Password)
+		secrets.add(auth.Token)
+	}
+
+	path := cfg.DockerConfig
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			path = filepath.Join(home, ".docker", "config.json")
+		}
+	}
+
+	return &credentialStore{
+		registries:   cfg.Registries,
+		dockerConfig: path,
+	}
+}
+
+// dockerConfigFile the parts of ~/.docker/config.json used for authentication.
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth,omitempty"`
+		IdentityToken string `json:"identitytoken,omitempty"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers,omitempty"`
+	CredsStore  string            `json:"credsStore,omitempty"`
+}
+
+// lookup returns the credentials for a registry host, and false if there are none.
+func (s *credentialStore) lookup(ctx *Context, host string) (RegistryAuth, bool) {
+	if s == nil {
+		return RegistryAuth{}, false
+	}
+
+	keys := registryKeys(host)
+	for _, key := range keys {
+		if auth, ok := s.registries[key]; ok {
+			return auth, true
+		}
+	}
+
+	if s.dockerConfig == "" {
+		return RegistryAuth{}, false
+	}
+
+	raw, err := ioutil.ReadFile(s.dockerConfig)
+	if err != nil {
+		return RegistryAuth{}, false
+	}
+
+	var cfg dockerConfigFile
+	err = json.Unmarshal(raw, &cfg)
+	if err != nil {
+		log.Warnw("Failed to parse docker config", "path", s.dockerConfig, "error", err)
+		return RegistryAuth{}, false
+	}
+
+	for _, key := range keys {
+		if helper, ok := cfg.CredHelpers[key]; ok {
+			return credentialsFromHelper(ctx, helper, key)
+		}
+	}
+
+	for _, key := range keys {
+		entry, ok := cfg.Auths[key]
+		if !ok {
+			continue
+		}
+
+		auth, err := decodeAuth(entry.Auth)
+		if err != nil {
+			log.Warnw("Invalid auth in docker config", "registry", key, "error", err)
+			continue
+		}
+		auth.Token = entry.IdentityToken
+		secrets.add(auth.Password)
+		secrets.add(auth.Token)
+		if !auth.empty() {
+			return auth, true
+		}
+	}
+
+	if cfg.CredsStore != "" {
+		for _, key := range keys {
+			auth, ok := credentialsFromHelper(ctx, cfg.CredsStore, key)
+			if ok {
+				return auth, true
+			}
+		}
+	}
+
+	return RegistryAuth{}, false
+}
+
+// registryKeys returns the keys a registry may be stored under, with the bare
+// host first. Docker stores Docker Hub under its legacy index URL and other
+// registries under the bare host.
+func registryKeys(host string) []string {
+	if host == dockerHubRegistry {
+		return []string{"docker.io", "index.docker.io", dockerHubRegistry, dockerHubAuthKey}
+	}
+	return []string{host, "https://" + host}
+}
+
+func decodeAuth(encoded string) (RegistryAuth, error) {
+	if encoded == "" {
+		return RegistryAuth{}, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return RegistryAuth{}, err
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return RegistryAuth{}, fmt.Errorf("malformed auth")
+	}
+
+	return RegistryAuth{Username: parts[0], Password: parts[1]}, nil
+}
+
+// credentialsFromHelper gets credentials from a docker credential helper, which
+// is killed if it does not answer within the credential helper timeout.
+func credentialsFromHelper(ctx *Context, helper, serverURL string) (RegistryAuth, bool) {
+	ctx, cancel := ctx.withTimeout(credentialHelperTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	if err != nil {
+		log.Warnw("Credential helper failed", "helper", helper, "registry", serverURL, "error", err, "requestId", ctx.id)
+		return RegistryAuth{}, false
+	}
+
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	err = json.Unmarshal(stdout.Bytes(), &creds)
+	if err != nil {
+		log.Warnw("Invalid credential helper output", "helper", helper, "error", err)
+		return RegistryAuth{}, false
+	}
+
+	secrets.add(creds.Secret)
+	if creds.Username == identityTokenUser {
+		return RegistryAuth{Token: creds.Secret}, true
+	}
+	return RegistryAuth{Username: creds.Username, Password: creds.Secret}, true
+}
+
+// writeDockerConfig writes a docker config directory holding only the given
+// credentials, for use with docker --config. The caller must remove it.
+func writeDockerConfig(host string, auth RegistryAuth) (string, error) {
+	dir, err := ioutil.TempDir("", "redeployer-docker-config")
+	if err != nil {
+		return "", err
+	}
+
+	key := host
+	if host == dockerHubRegistry {
+		key = dockerHubAuthKey
+	}
+
+	entry := map[string]string{}
+	if auth.Username != "" || auth.Password != "" {
+		entry["auth"] = base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+	}
+	if auth.Token != "" {
+		entry["identitytoken"] = auth.Token
+	}
+
+	content, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{key: entry},
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "config.json"), content, 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
+}
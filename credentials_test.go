@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCredentialStore_lookup(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "redeployer-credentials")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	helper := filepath.Join(dir, "docker-credential-test")
+	script := "#!/bin/sh\nread server\necho \"{\\\"ServerURL\\\":\\\"$server\\\",\\\"Username\\\":\\\"<token>\\\",\\\"Secret\\\":\\\"helper-token-for-$server\\\"}\"\n"
+	assert.NoError(ioutil.WriteFile(helper, []byte(script), 0755))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	dockerConfig := filepath.Join(dir, "config.json")
+	content := fmt.Sprintf(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "%s"},
+			"registry.example.com": {"identitytoken": "example-identity-token"}
+		},
+		"credHelpers": {"helped.example.com": "test"}
+	}`, base64.StdEncoding.EncodeToString([]byte("hubuser:hub-password")))
+	assert.NoError(ioutil.WriteFile(dockerConfig, []byte(content), 0600))
+
+	store := newCredentialStore(Config{
+		Registries: map[string]RegistryAuth{
+			"private.example.com:5000": {Username: "deployer", Password: "config-password"},
+		},
+		DockerConfig: dockerConfig,
+	})
+
+	auth, ok := store.lookup(newTestContext(), "private.example.com:5000")
+	assert.True(ok)
+	assert.Equal(RegistryAuth{Username: "deployer", Password: "config-password"}, auth)
+
+	auth, ok = store.lookup(newTestContext(), dockerHubRegistry)
+	assert.True(ok)
+	assert.Equal(RegistryAuth{Username: "hubuser", Password: "hub-password"}, auth)
+
+	auth, ok = store.lookup(newTestContext(), "registry.example.com")
+	assert.True(ok)
+	assert.Equal(RegistryAuth{Token: "example-identity-token"}, auth)
+
+	auth, ok = store.lookup(newTestContext(), "helped.example.com")
+	assert.True(ok)
+	assert.Equal(RegistryAuth{Token: "helper-token-for-helped.example.com"}, auth)
+
+	_, ok = store.lookup(newTestContext(), "unknown.example.com")
+	assert.False(ok)
+
+	var nilStore *credentialStore
+	_, ok = nilStore.lookup(newTestContext(), dockerHubRegistry)
+	assert.False(ok)
+
+	assert.Equal("RegistryAuth{Username: deployer}", fmt.Sprint(RegistryAuth{Username: "deployer", Password: "config-password"}))
+	assert.Equal("pulled with [REDACTED] and [REDACTED]", secrets.redact("pulled with config-password and helper-token-for-helped.example.com"))
+}
+
+func TestCredentialStore_lookupCredsStore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "redeployer-credentials")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	helper := filepath.Join(dir, "docker-credential-store")
+	script := "#!/bin/sh\nread server\nif [ \"$server\" != \"private.example.com\" ]; then echo \"credentials not found in native keychain\"; exit 1; fi\necho \"{\\\"Username\\\":\\\"deployer\\\",\\\"Secret\\\":\\\"store-password\\\"}\"\n"
+	assert.NoError(ioutil.WriteFile(helper, []byte(script), 0755))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	dockerConfig := filepath.Join(dir, "config.json")
+	assert.NoError(ioutil.WriteFile(dockerConfig, []byte(`{"credsStore": "store"}`), 0600))
+
+	store := newCredentialStore(Config{DockerConfig: dockerConfig})
+	auth, ok := store.lookup(newTestContext(), "private.example.com")
+	assert.True(ok)
+	assert.Equal(RegistryAuth{Username: "deployer", Password: "store-password"}, auth)
+
+	_, ok = store.lookup(newTestContext(), "unknown.example.com")
+	assert.False(ok)
+}
+
+func TestWriteDockerConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := writeDockerConfig(dockerHubRegistry, RegistryAuth{Username: "user", Password: "secret-password"})
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	assert.NoError(err)
+
+	var cfg dockerConfigFile
+	assert.NoError(json.Unmarshal(raw, &cfg))
+	auth, err := decodeAuth(cfg.Auths[dockerHubAuthKey].Auth)
+	assert.NoError(err)
+	assert.Equal(RegistryAuth{Username: "user", Password: "secret-password"}, auth)
+}
+
+func TestRegistryClient_credentials(t *testing.T) {
+	assert := assert.New(t)
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "deployer" || pass != "registry-password" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "authenticated"})
+		default:
+			if r.Header.Get("Authorization") != "Bearer authenticated" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"layers":[]}`))
+		}
+	}))
+	defer server.Close()
+
+	host := server.Listener.Addr().String()
+	client := &registryClient{
+		client: server.Client(),
+		credentials: &credentialStore{
+			registries: map[string]RegistryAuth{
+				host: {Username: "deployer", Password: "registry-password"},
+			},
+		},
+	}
+
+	_, err := client.getManifest(newTestContext(), host+"/repository/svc", "1.0")
+	assert.NoError(err)
+
+	client.credentials = nil
+	_, err = client.getManifest(newTestContext(), host+"/repository/svc", "1.0")
+	assert.Equal(errRegistryRequest, err)
+}
+
+func TestRedactingCore(t *testing.T) {
+	assert := assert.New(t)
+
+	secrets.add("super-secret-value")
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newRedactingCore(core)).Sugar().With("static", "with super-secret-value")
+
+	logger.Infow("Message containing super-secret-value",
+		"output", "login super-secret-value ok",
+		"error", fmt.Errorf("failed with super-secret-value"),
+		"job", Job{Output: "super-secret-value"},
+		"count", 3,
+	)
+
+	entries := logs.All()
+	assert.Len(entries, 1)
+	assert.Equal("Message containing [REDACTED]", entries[0].Message)
+
+	fields := entries[0].ContextMap()
+	assert.Equal("with [REDACTED]", fields["static"])
+	assert.Equal("login [REDACTED] ok", fields["output"])
+	assert.Equal("failed with [REDACTED]", fields["error"])
+	assert.Contains(fmt.Sprint(fields["job"]), "[REDACTED]")
+	assert.NotContains(fmt.Sprint(fields["job"]), "super-secret-value")
+	assert.Equal(int64(3), fields["count"])
+}
+
+func TestCredentialsFromHelper_timeout(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "redeployer-credentials")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	helper := filepath.Join(dir, "docker-credential-hang")
+	assert.NoError(ioutil.WriteFile(helper, []byte("#!/bin/sh\nexec sleep 30\n"), 0755))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	ctx, cancel := newTestContext().withTimeout(100 * time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, ok := credentialsFromHelper(ctx, "hang", "private.example.com")
+	assert.False(ok)
+	assert.True(time.Since(start) < 5*time.Second)
+}
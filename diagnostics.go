@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+const defaultFailureLogLines = 100
+
+// ContainerDiagnostics state and last log lines of a container, captured when a
+// deployment of it fails. They are recorded in the job and logged, since
+// redeployer does not send failure notifications.
+type ContainerDiagnostics struct {
+	Container    string `json:"container"`
+	Status       string `json:"status,omitempty"`
+	ExitCode     int    `json:"exitCode"`
+	OOMKilled    bool   `json:"oomKilled"`
+	RestartCount int    `json:"restartCount"`
+	Error        string `json:"error,omitempty"`
+	Logs         string `json:"logs,omitempty"`
+}
+
+// ContainerLogs returns the last lines of the logs of a container.
+func (c *cliDockerClient) ContainerLogs(ctx *Context, name string, lines int) (string, error) {
+	target := Target{
+		Binary: "docker",
+		Script: "logs",
+	}
+
+	output, err := target.execute(ctx, "--tail", strconv.Itoa(lines), name)
+	if err != nil {
+		log.Errorw("Failed to get container logs", "name", name, "output", output, "error", err, "requestId", ctx.id)
+	}
+
+	return output, err
+}
+
+// captureDiagnostics records the state and logs of the container a failed job
+// deployed. Only docker targets run containers which redeployer can inspect.
+func (e *env) captureDiagnostics(ctx *Context, target Target, job *Job, name string) {
+	if target.Type != "" && target.Type != typeDocker {
+		return
+	}
+
+	// The deployment may have timed out, which should not prevent looking at why.
+	ctx = ctx.detached()
+	raw, err := e.docker.InspectContainer(ctx, name)
+	if err != nil {
+		log.Warnw("Failed to inspect failed container", "name", name, "error", err, "requestId", ctx.id)
+		return
+	}
+
+	var inspect struct {
+		RestartCount int `json:"RestartCount"`
+		State        struct {
+			Status    string `json:"Status"`
+			ExitCode  int    `json:"ExitCode"`
+			OOMKilled bool   `json:"OOMKilled"`
+			Error     string `json:"Error"`
+		} `json:"State"`
+	}
+	err = json.Unmarshal(raw, &inspect)
+	if err != nil {
+		log.Warnw("Failed to parse container state", "name", name, "error", err, "requestId", ctx.id)
+		return
+	}
+
+	lines := target.FailureLogLines
+	if lines == 0 {
+		lines = defaultFailureLogLines
+	}
+	logs, _ := e.docker.ContainerLogs(ctx, name, lines)
+
+	job.Diagnostics = &ContainerDiagnostics{
+		Container:    name,
+		Status:       inspect.State.Status,
+		ExitCode:     inspect.State.ExitCode,
+		OOMKilled:    inspect.State.OOMKilled,
+		RestartCount: inspect.RestartCount,
+		Error:        secrets.redact(inspect.State.Error),
+		Logs:         secrets.redact(logs),
+	}
+	log.Warnw("Captured diagnostics of failed container", "diagnostics", job.Diagnostics, "requestId", ctx.id)
+}
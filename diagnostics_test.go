@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testCrashedInspect = `{
+	"Name": "/test-svc",
+	"RestartCount": 4,
+	"State": {"Status": "restarting", "ExitCode": 137, "OOMKilled": true, "Error": ""}
+}`
+
+func TestRedeployContainer_diagnostics(t *testing.T) {
+	assert := assert.New(t)
+
+	target := Target{
+		ID:              "test-svc",
+		Binary:          "false",
+		Script:          "deploy",
+		FailureLogLines: 20,
+	}
+
+	dc := &mockDockerClient{
+		GetImageIDOutput:       "repository/svc:1.0",
+		InspectContainerOutput: json.RawMessage(testCrashedInspect),
+		ContainerLogsOutput:    "panic: out of memory",
+	}
+	e := &env{docker: dc}
+
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	e.redeployContainer(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal(&ContainerDiagnostics{
+		Container:    "test-svc",
+		Status:       "restarting",
+		ExitCode:     137,
+		OOMKilled:    true,
+		RestartCount: 4,
+		Logs:         "panic: out of memory",
+	}, job.Diagnostics)
+	assert.Equal("test-svc", dc.ContainerLogsName)
+	assert.Equal(20, dc.ContainerLogsLines)
+}
+
+func TestRedeploy_probeFailureDiagnostics(t *testing.T) {
+	assert := assert.New(t)
+
+	target := Target{
+		ID:     "test-svc",
+		Binary: "/bin/sh",
+		Script: "./resources/test-svc.sh",
+		Probes: []Probe{{Type: probeExec, Command: []string{"false"}, Interval: time.Millisecond, Retries: 1}},
+	}
+
+	dc := &mockDockerClient{
+		GetImageIDOutput:       "repository/svc:1.0",
+		ExecErr:                fmt.Errorf("exit status 1"),
+		InspectContainerOutput: json.RawMessage(testCrashedInspect),
+	}
+	e := &env{docker: dc}
+
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	e.deploy(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Nil(job.Diagnostics)
+
+	err := e.runProbes(newTestContext(), target, job)
+	assert.Error(err)
+
+	e.redeploy(newTestContext(), target, "repository/svc:1.1")
+	assert.Equal("test-svc", dc.ContainerLogsName)
+	assert.Equal(defaultFailureLogLines, dc.ContainerLogsLines)
+
+	dc.Reset()
+	target.Type = typeCompose
+	e.captureDiagnostics(newTestContext(), target, job, "test-svc")
+	assert.Equal("", dc.InspectContainerArg)
+}
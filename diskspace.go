@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	defaultDockerRoot = "/var/lib/docker"
+	megabyte          = 1024 * 1024
+)
+
+var errInsufficientDiskSpace = fmt.Errorf("Insufficient disk space")
+
+// freeDiskSpace returns the number of bytes available at a path.
+var freeDiskSpace = diskFree
+
+// DiskSpaceGuard checks that the docker data root has room for an image before
+// it is pulled. At least minFreeMB must remain free after the compressed size of
+// the image is subtracted. With prune set, the retention policy of the target
+// is applied first if there is not enough room.
+type DiskSpaceGuard struct {
+	DataRoot  string `yaml:"dataRoot,omitempty"`
+	MinFreeMB int64  `yaml:"minFreeMB,omitempty"`
+	Prune     bool   `yaml:"prune,omitempty"`
+}
+
+func (g DiskSpaceGuard) validate() error {
+	if g.MinFreeMB < 0 {
+		return fmt.Errorf("minFreeMB must not be negative")
+	}
+	return nil
+}
+
+func (g DiskSpaceGuard) dataRoot() string {
+	if g.DataRoot != "" {
+		return g.DataRoot
+	}
+	return defaultDockerRoot
+}
+
+// checkDiskSpace verifies that there is room to pull the image of a job, pruning
+// old images of the target if configured to.
+func (e *env) checkDiskSpace(ctx *Context, target Target, job *Job) error {
+	guard := e.cfg.DiskSpace
+	if guard == nil || (target.Type != "" && target.Type != typeDocker && target.Type != typeCompose) {
+		return nil
+	}
+
+	required := uint64(guard.MinFreeMB*megabyte) + e.imageSize(ctx, job)
+	free, err := freeDiskSpace(guard.dataRoot())
+	if err != nil {
+		log.Warnw("Failed to check free disk space", "path", guard.dataRoot(), "error", err, "requestId", ctx.id)
+		return nil
+	}
+	if free >= required {
+		return nil
+	}
+
+	if guard.Prune && target.Retention != nil {
+		log.Infow("Pruning images to free disk space", "free", free, "required", required, "requestId", ctx.id)
+		e.applyRetention(ctx, target, job)
+		free, err = freeDiskSpace(guard.dataRoot())
+		if err == nil && free >= required {
+			return nil
+		}
+	}
+
+	log.Errorw("Not enough disk space to pull image", "image", job.Image, "free", free, "required", required, "requestId", ctx.id)
+	return fmt.Errorf("%s: %d MB free, %d MB required", errInsufficientDiskSpace, free/megabyte, required/megabyte)
+}
+
+// imageSize returns the compressed size of an image according to its manifest,
+// or 0 if it can not be determined.
+func (e *env) imageSize(ctx *Context, job *Job) uint64 {
+	ref, err := parseImageRef(job.Image)
+	if err != nil || e.registry == nil {
+		return 0
+	}
+
+	reference := ref.tag
+	if ref.digest != "" {
+		reference = ref.digest
+	} else if reference == "" {
+		reference = "latest"
+	}
+
+	m, err := e.registry.getManifest(ctx, ref.name, reference)
+	if err != nil {
+		log.Debugw("Failed to get image size", "image", job.Image, "error", err, "requestId", ctx.id)
+		return 0
+	}
+
+	size := uint64(m.Config.Size)
+	for _, layer := range m.Layers {
+		size += uint64(layer.Size)
+	}
+	return size
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"fmt"
+)
+
+func diskFree(path string) (uint64, error) {
+	return 0, fmt.Errorf("disk space check not supported on this platform")
+}
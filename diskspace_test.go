@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := newTestRegistry()
+	defer reg.server.Close()
+	reg.addManifest("repository/svc", "1.1", manifest{
+		Config: descriptor{Size: megabyte},
+		Layers: []descriptor{{Size: 100 * megabyte}, {Size: 99 * megabyte}},
+	})
+
+	free := uint64(1000 * megabyte)
+	defer func() { freeDiskSpace = diskFree }()
+	freeDiskSpace = func(path string) (uint64, error) {
+		return free, nil
+	}
+
+	now := time.Now()
+	dc := &pruningDockerClient{
+		removingDockerClient: removingDockerClient{
+			mockDockerClient: mockDockerClient{
+				ListImagesOutput: []ImageInfo{
+					{ID: "sha256:a", Repository: reg.host() + "/repository/svc", Tag: "0.9", Created: now.Add(-2 * time.Hour)},
+					{ID: "sha256:b", Repository: reg.host() + "/repository/svc", Tag: "1.0", Created: now.Add(-time.Hour)},
+				},
+			},
+		},
+		freed: &free,
+	}
+	e := &env{
+		cfg:      Config{DiskSpace: &DiskSpaceGuard{MinFreeMB: 800}},
+		docker:   dc,
+		registry: reg.client(),
+	}
+	target := Target{ID: "test-svc"}
+	image := reg.host() + "/repository/svc:1.1"
+
+	job := newJob(newTestContext(), target, image)
+	assert.Equal(uint64(200*megabyte), e.imageSize(newTestContext(), job))
+	assert.NoError(e.checkDiskSpace(newTestContext(), target, job))
+
+	free = 999 * megabyte
+	err := e.checkDiskSpace(newTestContext(), target, job)
+	assert.Error(err)
+	assert.Equal(fmt.Sprintf("%s: 999 MB free, 1000 MB required", errInsufficientDiskSpace), err.Error())
+
+	e.cfg.DiskSpace.Prune = true
+	target.Retention = &RetentionPolicy{KeepLast: 1}
+	job = newJob(newTestContext(), target, image)
+	assert.NoError(e.checkDiskSpace(newTestContext(), target, job))
+	assert.Equal([]string{reg.host() + "/repository/svc:0.9"}, dc.removed)
+	assert.Equal([]string{reg.host() + "/repository/svc:0.9"}, job.Retention.Removed)
+
+	job = newJob(newTestContext(), target, image)
+	e.pullImage(newTestContext(), target, job)
+	assert.Equal(image, dc.PullArg)
+
+	free = 0
+	dc.PullArg = ""
+	job = newJob(newTestContext(), target, image)
+	e.redeployContainer(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal("", dc.PullArg)
+	assert.Equal("", dc.RemoveContainerArg)
+}
+
+// pruningDockerClient frees 100 MB of disk space for every removed image.
+type pruningDockerClient struct {
+	removingDockerClient
+	freed *uint64
+}
+
+func (c *pruningDockerClient) RemoveImage(ctx *Context, image string) error {
+	*c.freed += 100 * megabyte
+	return c.removingDockerClient.RemoveImage(ctx, image)
+}
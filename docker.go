@@ -1,25 +1,75 @@
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
 
 var (
 	errNoSuchContainer = fmt.Errorf("No such container")
+	errNoDigest        = fmt.Errorf("No repository digest found for image")
 )
 
 // DockerClient interface for interacting with docker
 type DockerClient interface {
 	Pull(ctx *Context, image string) error
+	GetDigest(ctx *Context, image string) (string, error)
 	GetImageID(ctx *Context, name string) (string, error)
 	RemoveContainer(ctx *Context, name string) error
 	RemoveImage(ctx *Context, image string) error
+	ListImages(ctx *Context, repository string) ([]ImageInfo, error)
+	ImagesInUse(ctx *Context) (map[string]bool, error)
+	RunContainer(ctx *Context, name, image string, spec ContainerSpec) (string, error)
+	RunOnce(ctx *Context, name, image string, spec ContainerSpec) (string, int, error)
+	Exec(ctx *Context, name string, command []string) (string, error)
+	HealthStatus(ctx *Context, name string) (string, error)
+	ContainerLogs(ctx *Context, name string, lines int) (string, error)
+	InspectContainer(ctx *Context, name string) (json.RawMessage, error)
+	InspectImage(ctx *Context, image string) (json.RawMessage, error)
+	CreateContainer(ctx *Context, name string, config json.RawMessage) (string, error)
+	ComposeImage(ctx *Context, cfg Compose) (string, error)
+	ComposeUp(ctx *Context, cfg Compose, image string) (string, error)
+	ServiceImage(ctx *Context, name string) (string, error)
+	UpdateService(ctx *Context, cfg Swarm, image string) (string, error)
+	ServiceUpdateStatus(ctx *Context, name string) (ServiceUpdateStatus, error)
+}
+
+type cliDockerClient struct {
+	api         *dockerAPI
+	credentials *credentialStore
 }
 
-type cliDockerClient struct{}
+// registryEnv returns the environment that makes the docker CLI use the configured
+// credentials for the registry of an image, and a function that cleans it up.
+func (c *cliDockerClient) registryEnv(ctx *Context, image string) ([]string, func(), error) {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	host, _ := splitRepository(ref.name)
+	auth, ok := c.credentials.lookup(ctx, host)
+	if !ok {
+		return nil, func() {}, nil
+	}
+
+	dir, err := writeDockerConfig(host, auth)
+	if err != nil {
+		log.Errorw("Failed to write docker config", "error", err, "requestId", ctx.id)
+		return nil, func() {}, err
+	}
+
+	log.Debugw("Using registry credentials", "registry", host, "username", auth.Username, "requestId", ctx.id)
+	return []string{"DOCKER_CONFIG=" + dir}, func() { os.RemoveAll(dir) }, nil
+}
 
 func (c *cliDockerClient) Pull(ctx *Context, image string) error {
 	log.Debugw("Pulling image", "image", image, "requestId", ctx.id)
-	if true {
-		return nil
+	env, cleanup, err := c.registryEnv(ctx, image)
+	defer cleanup()
+	if err != nil {
+		return err
 	}
 
 	target := Target{
@@ -27,7 +77,7 @@ func (c *cliDockerClient) Pull(ctx *Context, image string) error {
 		Script: "pull",
 	}
 
-	output, err := target.execute(ctx, image)
+	output, err := target.executeWithEnv(ctx, env, image)
 	if err != nil {
 		log.Errorw("Failed to pull image", "output", output, "error", err, "requestId", ctx.id)
 	}
@@ -35,6 +85,41 @@ func (c *cliDockerClient) Pull(ctx *Context, image string) error {
 	return err
 }
 
+// GetDigest returns the repository digest that a pulled image resolved to.
+func (c *cliDockerClient) GetDigest(ctx *Context, image string) (string, error) {
+	log.Debugw("Resolving image digest", "image", image, "requestId", ctx.id)
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return "", err
+	}
+
+	target := Target{
+		Binary: "docker",
+		Script: "image",
+	}
+
+	output, err := target.execute(ctx, "inspect", "--format", "{{json .RepoDigests}}", image)
+	if err != nil {
+		log.Errorw("Failed to inspect image", "output", output, "error", err, "requestId", ctx.id)
+		return "", err
+	}
+
+	var repoDigests []string
+	err = json.Unmarshal([]byte(output), &repoDigests)
+	if err != nil {
+		return "", err
+	}
+
+	for _, repoDigest := range repoDigests {
+		candidate, err := parseImageRef(repoDigest)
+		if err == nil && candidate.familiarName() == ref.familiarName() {
+			return candidate.digest, nil
+		}
+	}
+
+	return "", errNoDigest
+}
+
 func (c *cliDockerClient) GetImageID(ctx *Context, name string) (string, error) {
 	log.Debugw("Retrieving image id", "name", name, "requestId", ctx.id)
 	target := Target{
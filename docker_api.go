@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// dockerAPI minimal client for the docker engine API, used where the docker CLI
+// cannot express what is needed.
+type dockerAPI struct {
+	base   string
+	client *http.Client
+}
+
+// newDockerAPI creates a client for the daemon in DOCKER_HOST, or the default
+// unix socket if it is not set.
+func newDockerAPI() *dockerAPI {
+	host := os.Getenv("DOCKER_HOST")
+	if strings.HasPrefix(host, "tcp://") {
+		return &dockerAPI{
+			base:   "http://" + strings.TrimPrefix(host, "tcp://"),
+			client: &http.Client{Timeout: 5 * time.Minute},
+		}
+	}
+
+	socket := strings.TrimPrefix(host, "unix://")
+	if socket == "" {
+		socket = defaultDockerSocket
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &dockerAPI{
+		base:   "http://docker",
+		client: &http.Client{Timeout: 5 * time.Minute, Transport: transport},
+	}
+}
+
+func (d *dockerAPI) post(ctx *Context, path string, query url.Values, body interface{}, v interface{}) error {
+	var raw []byte
+	if body != nil {
+		var err error
+		raw, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	u := d.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(contentTypeHeader, "application/json")
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var msg struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(res.Body).Decode(&msg)
+		return fmt.Errorf("Docker API request failed: %s %s", res.Status, msg.Message)
+	}
+
+	if v == nil {
+		ioutil.ReadAll(res.Body)
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Freeze actions.
+const (
+	freezeReject = "reject"
+	freezeQueue  = "queue"
+
+	dateLayout = "2006-01-02"
+)
+
+var (
+	errFrozen = fmt.Errorf("Deployment freeze in effect")
+
+	weekdays = map[string]time.Weekday{
+		"sun": time.Sunday,
+		"mon": time.Monday,
+		"tue": time.Tuesday,
+		"wed": time.Wednesday,
+		"thu": time.Thursday,
+		"fri": time.Friday,
+		"sat": time.Saturday,
+	}
+)
+
+// FreezeWindow period during which deployments are not allowed. A window either
+// recurs weekly on the given days between start and end (HH:MM, in the time
+// zone of the window, crossing midnight if end is before start), or covers an
+// absolute range from a date or time until a date (inclusive) or time.
+// Deployments during a freeze are rejected, or queued until it has ended.
+type FreezeWindow struct {
+	Name     string   `yaml:"name,omitempty"`
+	Timezone string   `yaml:"timezone,omitempty"`
+	Days     []string `yaml:"days,omitempty"`
+	Start    string   `yaml:"start,omitempty"`
+	End      string   `yaml:"end,omitempty"`
+	From     string   `yaml:"from,omitempty"`
+	Until    string   `yaml:"until,omitempty"`
+	Action   string   `yaml:"action,omitempty"`
+}
+
+func (w FreezeWindow) validate() error {
+	_, err := w.location()
+	if err != nil {
+		return err
+	}
+
+	switch w.Action {
+	case "", freezeReject, freezeQueue:
+	default:
+		return fmt.Errorf("unknown freeze action: %s", w.Action)
+	}
+
+	for _, day := range w.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("unknown weekday: %s", day)
+		}
+	}
+
+	weekly := w.Start != "" || w.End != ""
+	absolute := w.From != "" || w.Until != ""
+	if weekly == absolute {
+		return fmt.Errorf("freeze window %s needs either start and end or from and until", w.Name)
+	}
+
+	if weekly {
+		_, _, err = w.clock()
+		return err
+	}
+
+	_, _, err = w.dates()
+	return err
+}
+
+func (w FreezeWindow) location() (*time.Location, error) {
+	if w.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(w.Timezone)
+}
+
+// clock returns the start and end of a weekly window as minutes after midnight.
+func (w FreezeWindow) clock() (int, int, error) {
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid freeze start %q", w.Start)
+	}
+
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid freeze end %q", w.End)
+	}
+
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
+
+// dates returns the range of an absolute window. Dates without a time are taken
+// to be in the time zone of the window, and an until date includes the whole day.
+func (w FreezeWindow) dates() (time.Time, time.Time, error) {
+	loc, err := w.location()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	from, err := parseFreezeTime(w.From, loc, false)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid freeze from %q", w.From)
+	}
+
+	until, err := parseFreezeTime(w.Until, loc, true)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid freeze until %q", w.Until)
+	}
+
+	return from, until, nil
+}
+
+func parseFreezeTime(value string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("missing time")
+	}
+
+	t, err := time.ParseInLocation(dateLayout, value, loc)
+	if err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// until returns the end of the window if it is in effect at the given time, or
+// the zero time otherwise.
+func (w FreezeWindow) until(now time.Time) time.Time {
+	if w.From != "" {
+		from, until, err := w.dates()
+		if err == nil && !now.Before(from) && now.Before(until) {
+			return until
+		}
+		return time.Time{}
+	}
+
+	loc, err := w.location()
+	if err != nil {
+		return time.Time{}
+	}
+	start, end, err := w.clock()
+	if err != nil {
+		return time.Time{}
+	}
+
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	// The end is built from the wall clock rather than by adding minutes to
+	// midnight, which would be off by an hour on days when DST changes.
+	endOn := func(days int) time.Time {
+		return time.Date(local.Year(), local.Month(), local.Day()+days, end/60, end%60, 0, 0, loc)
+	}
+
+	if start < end {
+		if w.onDay(local.Weekday()) && minute >= start && minute < end {
+			return endOn(0)
+		}
+		return time.Time{}
+	}
+
+	// The window crosses midnight, so it may have started today or yesterday.
+	if w.onDay(local.Weekday()) && minute >= start {
+		return endOn(1)
+	}
+	if w.onDay((local.Weekday()+6)%7) && minute < end {
+		return endOn(0)
+	}
+	return time.Time{}
+}
+
+func (w FreezeWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// activeFreeze returns the global or target freeze window in effect at the given
+// time, and whether there is one. Windows which reject deployments take
+// precedence over windows which queue them, and otherwise the one which ends
+// last is returned.
+func (e *env) activeFreeze(target Target, now time.Time) (FreezeWindow, time.Time, bool) {
+	var active FreezeWindow
+	var end time.Time
+	for _, w := range append(append([]FreezeWindow{}, e.cfg.Freeze...), target.Freeze...) {
+		until := w.until(now)
+		if until.IsZero() {
+			continue
+		}
+
+		rejects, activeRejects := w.Action != freezeQueue, active.Action != freezeQueue
+		if end.IsZero() || (rejects && !activeRejects) || (rejects == activeRejects && until.After(end)) {
+			active, end = w, until
+		}
+	}
+
+	return active, end, !end.IsZero()
+}
+
+// checkFreeze decides what to do with a redeployment request during a freeze.
+// It returns http.StatusAccepted if the redeployment should be queued.
+func (e *env) checkFreeze(ctx *Context, target Target, req RedeploymentRequest) (int, error) {
+	window, until, frozen := e.activeFreeze(target, time.Now())
+	if !frozen {
+		return http.StatusOK, nil
+	}
+
+	if req.Override {
+		if req.Reason == "" {
+			return http.StatusBadRequest, fmt.Errorf("%s: overriding a freeze requires a reason", errBadRequest)
+		}
+		if !e.mayOverrideFreeze(ctx.identity) {
+			log.Warnw("Identity not allowed to override freeze", "identity", ctx.identity, "service", target.ID, "freeze", window.Name, "requestId", ctx.id)
+			return http.StatusForbidden, fmt.Errorf("%s: identity may not override a freeze", errForbidden)
+		}
+		log.Warnw("Deployment freeze overridden",
+			"audit", true,
+			"service", target.ID,
+			"image", req.Image,
+			"freeze", window.Name,
+			"reason", req.Reason,
+			"identity", ctx.identity,
+			"approvedBy", ctx.approver,
+			"ip", ctx.ip,
+			"requestId", ctx.id,
+		)
+		return http.StatusOK, nil
+	}
+
+	if window.Action == freezeQueue {
+		log.Infow("Queueing redeployment until freeze ends", "service", target.ID, "freeze", window.Name, "until", until, "requestId", ctx.id)
+		return http.StatusAccepted, nil
+	}
+
+	log.Warnw("Redeployment rejected during freeze", "service", target.ID, "freeze", window.Name, "until", until, "requestId", ctx.id)
+	return http.StatusForbidden, fmt.Errorf("%s: %s until %s", errFrozen, window.Name, until.Format(time.RFC3339))
+}
+
+// mayOverrideFreeze reports whether an identity is configured to override freezes.
+func (e *env) mayOverrideFreeze(identity string) bool {
+	for _, allowed := range e.cfg.FreezeOverrideIdentities {
+		if identity == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// queuedDeployment redeployment waiting for a freeze to end.
+type queuedDeployment struct {
+	ctx   *Context
+	image string
+}
+
+// redeployAfterFreeze queues a redeployment until no freeze applies to the target
+// any more. Only the latest queued redeployment of a target is kept.
+func (e *env) redeployAfterFreeze(ctx *Context, target Target, image string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.queued == nil {
+		e.queued = make(map[string]queuedDeployment)
+	}
+
+	previous, waiting := e.queued[target.ID]
+	e.queued[target.ID] = queuedDeployment{ctx: ctx, image: image}
+	if waiting {
+		log.Infow("Replaced queued redeployment", "service", target.ID, "image", image, "replaced", previous.image, "replacedRequestId", previous.ctx.id, "requestId", ctx.id)
+		return
+	}
+
+	go e.runQueued(target)
+}
+
+// runQueued waits for the freeze on a target to end and runs the redeployment
+// queued for it, provided that it still passes the policies of the target.
+func (e *env) runQueued(target Target) {
+	for {
+		_, until, frozen := e.activeFreeze(target, time.Now())
+		if !frozen {
+			break
+		}
+		time.Sleep(time.Until(until))
+	}
+
+	e.mu.Lock()
+	queued := e.queued[target.ID]
+	delete(e.queued, target.ID)
+	e.mu.Unlock()
+
+	ctx := queued.ctx
+	_, err := e.checkPolicies(ctx, target, queued.image)
+	if err != nil {
+		log.Warnw("Dropped queued redeployment", "service", target.ID, "image", queued.image, "error", err, "requestId", ctx.id)
+		return
+	}
+
+	if wait := e.reserveMinInterval(target, time.Now()); wait > 0 {
+		log.Warnw("Dropped queued redeployment, target deployed too recently", "service", target.ID, "image", queued.image, "minInterval", target.MinInterval, "requestId", ctx.id)
+		return
+	}
+
+	e.redeploy(ctx, target, queued.image)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreezeWindow_until(t *testing.T) {
+	assert := assert.New(t)
+
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+	assert.NoError(err)
+
+	businessHours := FreezeWindow{Timezone: "Europe/Stockholm", Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "08:00", End: "17:00"}
+	assert.NoError(businessHours.validate())
+
+	// Wednesday 2020-06-03.
+	assert.Equal(time.Date(2020, 6, 3, 17, 0, 0, 0, stockholm), businessHours.until(time.Date(2020, 6, 3, 9, 30, 0, 0, stockholm)))
+	assert.Equal(time.Date(2020, 6, 3, 17, 0, 0, 0, stockholm), businessHours.until(time.Date(2020, 6, 3, 7, 30, 0, 0, time.UTC)))
+	assert.True(businessHours.until(time.Date(2020, 6, 3, 17, 0, 0, 0, stockholm)).IsZero())
+	assert.True(businessHours.until(time.Date(2020, 6, 6, 12, 0, 0, 0, stockholm)).IsZero())
+
+	overnight := FreezeWindow{Days: []string{"Fri"}, Start: "22:00", End: "06:00"}
+	assert.NoError(overnight.validate())
+	assert.Equal(time.Date(2020, 6, 6, 6, 0, 0, 0, time.UTC), overnight.until(time.Date(2020, 6, 5, 23, 0, 0, 0, time.UTC)))
+	assert.Equal(time.Date(2020, 6, 6, 6, 0, 0, 0, time.UTC), overnight.until(time.Date(2020, 6, 6, 1, 0, 0, 0, time.UTC)))
+	assert.True(overnight.until(time.Date(2020, 6, 5, 1, 0, 0, 0, time.UTC)).IsZero())
+
+	// DST starts in Stockholm on Sunday 2020-03-29 and ends on Sunday 2020-10-25.
+	weekend := FreezeWindow{Timezone: "Europe/Stockholm", Days: []string{"sun"}, Start: "00:00", End: "12:00"}
+	assert.Equal(time.Date(2020, 3, 29, 12, 0, 0, 0, stockholm), weekend.until(time.Date(2020, 3, 29, 11, 30, 0, 0, stockholm)))
+	assert.Equal(time.Date(2020, 10, 25, 12, 0, 0, 0, stockholm), weekend.until(time.Date(2020, 10, 25, 11, 30, 0, 0, stockholm)))
+	saturdayNight := FreezeWindow{Timezone: "Europe/Stockholm", Days: []string{"sat"}, Start: "22:00", End: "06:00"}
+	assert.Equal(time.Date(2020, 3, 29, 6, 0, 0, 0, stockholm), saturdayNight.until(time.Date(2020, 3, 28, 23, 0, 0, 0, stockholm)))
+	assert.Equal(time.Date(2020, 10, 25, 6, 0, 0, 0, stockholm), saturdayNight.until(time.Date(2020, 10, 25, 5, 0, 0, 0, stockholm)))
+
+	holidays := FreezeWindow{Timezone: "Europe/Stockholm", From: "2020-12-23", Until: "2020-12-26"}
+	assert.NoError(holidays.validate())
+	assert.Equal(time.Date(2020, 12, 27, 0, 0, 0, 0, stockholm), holidays.until(time.Date(2020, 12, 26, 22, 0, 0, 0, stockholm)))
+	assert.True(holidays.until(time.Date(2020, 12, 22, 22, 0, 0, 0, time.UTC)).IsZero())
+
+	release := FreezeWindow{From: "2020-06-01T10:00:00Z", Until: "2020-06-01T12:00:00Z"}
+	assert.NoError(release.validate())
+	assert.False(release.until(time.Date(2020, 6, 1, 11, 0, 0, 0, time.UTC)).IsZero())
+
+	assert.Error(FreezeWindow{Start: "08:00", End: "17:00", From: "2020-01-01", Until: "2020-01-02"}.validate())
+	assert.Error(FreezeWindow{}.validate())
+	assert.Error(FreezeWindow{Start: "8am", End: "17:00"}.validate())
+	assert.Error(FreezeWindow{Days: []string{"someday"}, Start: "08:00", End: "17:00"}.validate())
+	assert.Error(FreezeWindow{Timezone: "Mars/Olympus", Start: "08:00", End: "17:00"}.validate())
+	assert.Error(FreezeWindow{From: "2020-01-01", Until: "2020-01-02", Action: "ignore"}.validate())
+}
+
+func TestActiveFreeze(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2020, 6, 3, 12, 0, 0, 0, time.UTC)
+	e := &env{cfg: Config{Freeze: []FreezeWindow{
+		{Name: "release", From: "2020-06-01", Until: "2020-06-30", Action: freezeQueue},
+		{Name: "incident", From: "2020-06-03", Until: "2020-06-03"},
+	}}}
+	target := Target{ID: "test-svc", Freeze: []FreezeWindow{
+		{Name: "maintenance", From: "2020-06-01", Until: "2020-06-05"},
+	}}
+
+	window, until, frozen := e.activeFreeze(target, now)
+	assert.True(frozen)
+	assert.Equal("maintenance", window.Name)
+	assert.Equal(time.Date(2020, 6, 6, 0, 0, 0, 0, time.UTC), until)
+
+	window, _, frozen = e.activeFreeze(Target{ID: "other-svc"}, now)
+	assert.True(frozen)
+	assert.Equal("incident", window.Name)
+
+	window, _, frozen = e.activeFreeze(Target{ID: "other-svc"}, now.AddDate(0, 0, 1))
+	assert.True(frozen)
+	assert.Equal("release", window.Name)
+
+	_, _, frozen = e.activeFreeze(Target{ID: "other-svc"}, now.AddDate(0, 1, 0))
+	assert.False(frozen)
+}
+
+func TestRunQueued(t *testing.T) {
+	assert := assert.New(t)
+
+	dc := &mockDockerClient{
+		GetImageIDOutput: "repository/svc:1.4.2",
+	}
+	target := Target{
+		ID:          "test-svc",
+		Binary:      "/bin/sh",
+		Script:      "./resources/test-svc.sh",
+		MustMatch:   "^repository/svc:.*",
+		MinInterval: time.Hour,
+		VersionPolicy: &VersionPolicy{
+			DenyDowngrade: true,
+		},
+	}
+	e := &env{docker: dc}
+
+	e.queued = map[string]queuedDeployment{
+		target.ID: {ctx: newTestContext(), image: "repository/svc:1.4.1"},
+	}
+	e.runQueued(target)
+	assert.Equal("", dc.PullArg)
+	assert.Empty(e.queued)
+
+	e.queued[target.ID] = queuedDeployment{ctx: newTestContext(), image: "repository/svc:1.4.3"}
+	e.runQueued(target)
+	assert.Equal("repository/svc:1.4.3", dc.PullArg)
+
+	dc.Reset()
+	dc.GetImageIDOutput = "repository/svc:1.4.3"
+	e.queued[target.ID] = queuedDeployment{ctx: newTestContext(), image: "repository/svc:1.4.4"}
+	e.runQueued(target)
+	assert.Equal("", dc.PullArg)
+}
+
+func TestRedeploy_freeze(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+
+	dc := &mockDockerClient{
+		GetImageIDOutput: "repository/svc:1.0",
+	}
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			Freeze: []FreezeWindow{
+				{Name: "forever", From: "2000-01-01", Until: "2999-12-31"},
+			},
+			FreezeOverrideIdentities: []string{"release-manager"},
+			Services: map[string]Target{
+				"test-svc": Target{
+					ID:        "test-svc",
+					Binary:    "/bin/sh",
+					Script:    "./resources/test-svc.sh",
+					MustMatch: "^repository/svc:.*",
+				},
+			},
+		},
+		docker: dc,
+	}
+	server := newServer(e, 9000)
+
+	reqFrozen := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.1",
+	})
+	reqFrozen.Header.Set(tokenHeader, deployToken)
+	resFrozen := performTestRequest(server.Handler, reqFrozen)
+	assert.Equal(http.StatusForbidden, resFrozen.Code)
+
+	reqNoReason := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target:   "test-svc",
+		Image:    "repository/svc:1.1",
+		Override: true,
+	})
+	reqNoReason.Header.Set(tokenHeader, deployToken)
+	resNoReason := performTestRequest(server.Handler, reqNoReason)
+	assert.Equal(http.StatusBadRequest, resNoReason.Code)
+
+	e.cfg.Freeze[0].Action = freezeQueue
+	reqQueued := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.1",
+	})
+	reqQueued.Header.Set(tokenHeader, deployToken)
+	resQueued := performTestRequest(server.Handler, reqQueued)
+	assert.Equal(http.StatusAccepted, resQueued.Code)
+
+	reqLatest := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.2",
+	})
+	reqLatest.Header.Set(tokenHeader, deployToken)
+	resLatest := performTestRequest(server.Handler, reqLatest)
+	assert.Equal(http.StatusAccepted, resLatest.Code)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal("", dc.PullArg)
+	e.mu.Lock()
+	assert.Len(e.queued, 1)
+	assert.Equal("repository/svc:1.2", e.queued["test-svc"].image)
+	e.mu.Unlock()
+
+	reqNotAllowed := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target:   "test-svc",
+		Image:    "repository/svc:1.1",
+		Override: true,
+		Reason:   "hotfix for outage",
+	})
+	reqNotAllowed.Header.Set(tokenHeader, deployToken)
+	resNotAllowed := performTestRequest(server.Handler, reqNotAllowed)
+	assert.Equal(http.StatusForbidden, resNotAllowed.Code)
+
+	e.cfg.FreezeOverrideIdentities = []string{defaultCredential}
+	reqOverride := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target:   "test-svc",
+		Image:    "repository/svc:1.1",
+		Override: true,
+		Reason:   "hotfix for outage",
+	})
+	reqOverride.Header.Set(tokenHeader, deployToken)
+	resOverride := performTestRequest(server.Handler, reqOverride)
+	assert.Equal(http.StatusOK, resOverride.Code)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal("repository/svc:1.1", dc.PullArg)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Hook phases and failure handling.
+const (
+	hookPreDeploy  = "preDeploy"
+	hookPostDeploy = "postDeploy"
+
+	hookAbort    = "abort"
+	hookContinue = "continue"
+
+	defaultHookTimeout = 5 * time.Minute
+)
+
+var errHookFailed = fmt.Errorf("Deployment hook failed")
+
+// Hook command run before or after a deployment, in the same way as a target
+// script. Hooks abort the deployment when they fail unless onFailure is continue.
+type Hook struct {
+	Name      string        `yaml:"name,omitempty"`
+	Binary    string        `yaml:"binary,omitempty"`
+	Script    string        `yaml:"script,omitempty"`
+	Args      []string      `yaml:"args,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	OnFailure string        `yaml:"onFailure,omitempty"`
+}
+
+func (h Hook) validate() error {
+	if h.Binary == "" {
+		return fmt.Errorf("hooks require a binary")
+	}
+
+	switch h.OnFailure {
+	case "", hookAbort, hookContinue:
+	default:
+		return fmt.Errorf("unknown hook onFailure: %s", h.OnFailure)
+	}
+
+	if h.Timeout < 0 {
+		return fmt.Errorf("hook timeout must not be negative")
+	}
+	return nil
+}
+
+func (h Hook) name() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if h.Script != "" {
+		return h.Script
+	}
+	return h.Binary
+}
+
+// HookResult outcome of running a hook, recorded in the job.
+type HookResult struct {
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// runHooks runs the hooks of a phase in order and records their results in the
+// job. It returns an error if a hook which aborts on failure failed, in which
+// case the remaining hooks are skipped.
+func runHooks(ctx *Context, phase string, hooks []Hook, job *Job) error {
+	for _, hook := range hooks {
+		timeout := hook.Timeout
+		if timeout == 0 {
+			timeout = defaultHookTimeout
+		}
+
+		log.Debugw("Running deployment hook", "hook", hook.name(), "phase", phase, "requestId", ctx.id)
+		start := time.Now()
+		hookCtx, cancel := ctx.withTimeout(timeout)
+		cmd := Target{
+			Binary: hook.Binary,
+			Script: hook.Script,
+		}
+		output, err := cmd.executeWithEnv(hookCtx, job.env(), hook.Args...)
+		cancel()
+
+		result := HookResult{
+			Name:     hook.name(),
+			Phase:    phase,
+			Output:   secrets.redact(output),
+			Duration: time.Since(start).String(),
+		}
+		if err != nil {
+			result.Error = secrets.redact(err.Error())
+		}
+		job.Hooks = append(job.Hooks, result)
+
+		if err == nil {
+			continue
+		}
+
+		log.Errorw("Deployment hook failed", "hook", hook.name(), "phase", phase, "output", output, "error", err, "requestId", ctx.id)
+		if hook.OnFailure != hookContinue {
+			return fmt.Errorf("%s: %s", errHookFailed, hook.name())
+		}
+	}
+
+	return nil
+}
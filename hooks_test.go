@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	hooks := []Hook{
+		{Name: "tag", Binary: "/bin/sh", Script: "-c", Args: []string{"echo deploying $REDEPLOYER_TAG"}},
+		{Name: "flaky", Binary: "/bin/sh", Script: "-c", Args: []string{"echo failed; exit 1"}, OnFailure: hookContinue},
+		{Name: "slow", Binary: "/bin/sh", Script: "-c", Args: []string{"exec sleep 5"}, Timeout: 50 * time.Millisecond},
+		{Name: "skipped", Binary: "/bin/sh", Script: "-c", Args: []string{"echo skipped"}},
+	}
+
+	job := newJob(newTestContext(), Target{ID: "test-svc"}, "repository/svc:1.1")
+	err := runHooks(newTestContext(), hookPreDeploy, hooks, job)
+	assert.Error(err)
+	assert.Contains(err.Error(), "slow")
+
+	assert.Len(job.Hooks, 3)
+	assert.Equal("tag", job.Hooks[0].Name)
+	assert.Equal(hookPreDeploy, job.Hooks[0].Phase)
+	assert.Equal("deploying 1.1", job.Hooks[0].Output)
+	assert.Empty(job.Hooks[0].Error)
+	assert.Equal("failed", job.Hooks[1].Output)
+	assert.NotEmpty(job.Hooks[1].Error)
+	assert.NotEmpty(job.Hooks[2].Error)
+
+	assert.Error(Hook{Binary: "/bin/sh", OnFailure: "ignore"}.validate())
+	assert.Error(Hook{Script: "-c"}.validate())
+	assert.NoError(Hook{Binary: "/bin/sh", OnFailure: hookContinue}.validate())
+}
+
+func TestRunHooks_binaryWithArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	hooks := []Hook{
+		{Binary: "/bin/echo", Args: []string{"first", "second"}},
+	}
+	assert.NoError(hooks[0].validate())
+
+	job := newJob(newTestContext(), Target{ID: "test-svc"}, "repository/svc:1.1")
+	err := runHooks(newTestContext(), hookPostDeploy, hooks, job)
+	assert.NoError(err)
+	assert.Len(job.Hooks, 1)
+	assert.Equal("/bin/echo", job.Hooks[0].Name)
+	assert.Equal("first second", job.Hooks[0].Output)
+}
+
+func TestRedeploy_hooks(t *testing.T) {
+	assert := assert.New(t)
+
+	target := Target{
+		ID:     "test-svc",
+		Binary: "/bin/sh",
+		Script: "./resources/test-svc.sh",
+		PreDeploy: []Hook{
+			{Name: "drain", Binary: "/bin/sh", Script: "-c", Args: []string{"exit 1"}},
+		},
+		PostDeploy: []Hook{
+			{Name: "warm", Binary: "/bin/sh", Script: "-c", Args: []string{"echo warm"}},
+		},
+	}
+
+	dc := &mockDockerClient{}
+	e := &env{docker: dc}
+	e.redeploy(newTestContext(), target, "repository/svc:1.1")
+	assert.Equal("", dc.PullArg)
+
+	target.PreDeploy[0].Args = []string{"echo drained"}
+	e.redeploy(newTestContext(), target, "repository/svc:1.1")
+	assert.Equal("repository/svc:1.1", dc.PullArg)
+}
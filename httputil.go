@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,6 +16,8 @@ const (
 	requestIDHeader   = "X-Request-ID"
 	tokenHeader       = "X-Deploy-Token"
 	contentTypeHeader = "Content-Type"
+
+	defaultCredential = "default"
 )
 
 var (
@@ -27,10 +31,13 @@ var (
 
 // Context request context.
 type Context struct {
-	id    string
-	start time.Time
-	w     http.ResponseWriter
-	r     *http.Request
+	id       string
+	ip       string
+	identity string
+	approver string
+	start    time.Time
+	w        http.ResponseWriter
+	r        *http.Request
 	context.Context
 }
 
@@ -39,6 +46,36 @@ func (ctx *Context) latency() string {
 	return fmt.Sprintf("%.2f ms", float64(duration)/1e6)
 }
 
+// withTimeout returns a copy of the context which is cancelled after the timeout.
+func (ctx *Context) withTimeout(timeout time.Duration) (*Context, context.CancelFunc) {
+	c, cancel := context.WithTimeout(ctx.Context, timeout)
+	return &Context{
+		id:       ctx.id,
+		ip:       ctx.ip,
+		identity: ctx.identity,
+		approver: ctx.approver,
+		start:    ctx.start,
+		w:        ctx.w,
+		r:        ctx.r,
+		Context:  c,
+	}, cancel
+}
+
+// detached returns a copy of the context which is not cancelled along with it,
+// for cleaning up after an operation has timed out.
+func (ctx *Context) detached() *Context {
+	return &Context{
+		id:       ctx.id,
+		ip:       ctx.ip,
+		identity: ctx.identity,
+		approver: ctx.approver,
+		start:    ctx.start,
+		w:        ctx.w,
+		r:        ctx.r,
+		Context:  context.Background(),
+	}
+}
+
 func newContext(w http.ResponseWriter, r *http.Request) (*Context, error) {
 	requestID := r.Header.Get(requestIDHeader)
 	if requestID == "" {
@@ -62,21 +99,88 @@ func newContext(w http.ResponseWriter, r *http.Request) (*Context, error) {
 // authentication for specific routes, mathing a routes to http methods
 // and wrapping HandlerFuncs with error handling an logging.
 type router struct {
-	mux     *http.ServeMux
-	authKey scryptKey
+	mux         *http.ServeMux
+	credentials []credential
+	limits      *rateLimits
+	guard       *authGuard
+	allowed     ipAllowlist
+	routes      map[string]ipAllowlist
+	proxies     ipAllowlist
+	clients     map[string]string
+	patterns    map[string]bool
 }
 
-func newRouter(authKey AuthKey) *router {
-	key, err := parseKey(authKey.Key)
+// credential named key that a deploy token can be checked against.
+type credential struct {
+	name string
+	key  scryptKey
+}
+
+func newRouter(cfg Config) *router {
+	allowed, err := parseAllowlist(cfg.AllowedIPs)
+	if err != nil {
+		log.Fatalw("Invalid allowlist", "error", err)
+	}
+
+	proxies, err := parseAllowlist(cfg.TrustedProxies)
 	if err != nil {
-		log.Fatalw("Failed to parse key", "key", authKey.Key, "")
+		log.Fatalw("Invalid trusted proxies", "error", err)
+	}
+
+	routes := make(map[string]ipAllowlist)
+	for pattern, cidrs := range cfg.RouteAllowedIPs {
+		routes[pattern], err = parseAllowlist(cidrs)
+		if err != nil {
+			log.Fatalw("Invalid allowlist", "route", pattern, "error", err)
+		}
 	}
-	key.salt = authKey.Salt
 
 	return &router{
-		mux:     http.NewServeMux(),
-		authKey: key,
+		mux:         http.NewServeMux(),
+		credentials: parseCredentials(cfg),
+		limits:      newRateLimits(cfg.RateLimits),
+		guard:       newAuthGuard(cfg.AuthProtection),
+		allowed:     allowed,
+		routes:      routes,
+		proxies:     proxies,
+		clients:     clientIdentities(cfg.TLS),
+		patterns:    make(map[string]bool),
+	}
+}
+
+// parseCredentials returns the keys that deploy tokens are accepted for. The
+// authentication key is named default. When clients are only identified by
+// certificates no key is required and the list may be empty.
+func parseCredentials(cfg Config) []credential {
+	keys := make(map[string]AuthKey)
+	for name, key := range cfg.Credentials {
+		keys[name] = key
+	}
+	certificatesOnly := cfg.TLS != nil && len(cfg.TLS.ClientIdentities) > 0
+	if cfg.Authentication.Key != "" || (len(keys) == 0 && !certificatesOnly) {
+		keys[defaultCredential] = cfg.Authentication
+	}
+
+	credentials := make([]credential, 0, len(keys))
+	for _, name := range sortedAuthKeys(keys) {
+		key, err := parseKey(keys[name].Key)
+		if err != nil {
+			log.Fatalw("Failed to parse key", "credential", name, "key", keys[name].Key)
+		}
+		key.salt = keys[name].Salt
+		credentials = append(credentials, credential{name: name, key: key})
+	}
+
+	return credentials
+}
+
+func sortedAuthKeys(m map[string]AuthKey) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
 }
 
 func (router *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -84,11 +188,29 @@ func (router *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (router *router) GET(pattern string, h handlerFunc, useAuth bool) {
-	router.mux.Handle(pattern, newHandler(http.MethodGet, h, router.authKey, useAuth))
+	router.patterns[pattern] = true
+	router.mux.Handle(pattern, newHandler(http.MethodGet, pattern, h, router, useAuth))
 }
 
 func (router *router) POST(pattern string, h handlerFunc, useAuth bool) {
-	router.mux.Handle(pattern, newHandler(http.MethodPost, h, router.authKey, useAuth))
+	router.patterns[pattern] = true
+	router.mux.Handle(pattern, newHandler(http.MethodPost, pattern, h, router, useAuth))
+}
+
+// checkRouteAllowlists verifies that allowlists are only configured for
+// registered routes, as an allowlist for a misspelled route would never apply.
+func (router *router) checkRouteAllowlists() error {
+	unknown := make([]string, 0)
+	for pattern := range router.routes {
+		if !router.patterns[pattern] {
+			unknown = append(unknown, pattern)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("allowlists configured for unknown routes: %s", strings.Join(unknown, ", "))
+	}
+	return nil
 }
 
 // HandlerFunc signature of a request handler.
@@ -97,19 +219,30 @@ type handlerFunc func(*Context) (int, error)
 // Handler wrapper around a HandlerFunc to provide
 // authentication, method checking, logging and error handling.
 type handler struct {
-	method  string
-	handle  handlerFunc
-	authKey scryptKey
-	useAuth bool
+	method      string
+	handle      handlerFunc
+	credentials []credential
+	limits      *rateLimits
+	guard       *authGuard
+	allowlists  []ipAllowlist
+	proxies     ipAllowlist
+	clients     map[string]string
+	useAuth     bool
 }
 
-// NewHandler creates and returns a new Handler.
-func newHandler(method string, h handlerFunc, key scryptKey, useAuth bool) *handler {
+// NewHandler creates and returns a new Handler using the credentials, client
+// identities, rate limits, brute force protection and allowlists of a router.
+func newHandler(method, pattern string, h handlerFunc, router *router, useAuth bool) *handler {
 	return &handler{
-		method:  method,
-		handle:  h,
-		useAuth: useAuth,
-		authKey: key,
+		method:      method,
+		handle:      h,
+		useAuth:     useAuth,
+		credentials: router.credentials,
+		limits:      router.limits,
+		guard:       router.guard,
+		allowlists:  []ipAllowlist{router.allowed, router.routes[pattern]},
+		proxies:     router.proxies,
+		clients:     router.clients,
 	}
 }
 
@@ -132,14 +265,75 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.authenticate(r)
+	ip := clientIP(r, h.proxies)
+	ctx.ip = ip
+	for _, allowlist := range h.allowlists {
+		if !allowlist.allows(ip) {
+			status = http.StatusForbidden
+			log.Warnw("Rejected request from address not in allowlist", "ip", ip, "requestId", ctx.id)
+			ctx.sendError(errForbidden, status)
+			logOutgoingRequest(ctx, status)
+			return
+		}
+	}
+
+	ok, retryAfter := h.limits.perIP.allow(ip, time.Now())
+	if !ok {
+		status = http.StatusTooManyRequests
+		rateLimited.inc()
+		log.Warnw("Rate limited client", "ip", ip, "requestId", ctx.id)
+		ctx.sendTooManyRequests(retryAfter)
+		logOutgoingRequest(ctx, status)
+		return
+	}
+
+	endAttempt := func() {}
+	if h.useAuth {
+		var lockout time.Duration
+		lockout, endAttempt = h.guard.begin(ip, time.Now())
+		if lockout > 0 {
+			status = http.StatusTooManyRequests
+			authLockedOut.inc()
+			log.Warnw("Rejected request from locked out client", "ip", ip, "requestId", ctx.id)
+			ctx.sendTooManyRequests(lockout)
+			logOutgoingRequest(ctx, status)
+			return
+		}
+		defer endAttempt()
+	}
+
+	ctx.identity, err = h.authenticate(r)
 	if err != nil {
 		status = http.StatusUnauthorized
-		ctx.sendError(err, http.StatusUnauthorized)
+		if err == errServiceUnavailable {
+			status = http.StatusServiceUnavailable
+		} else {
+			delay := h.guard.fail(ctx, ip, time.Now())
+			endAttempt()
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+			}
+		}
+		ctx.sendError(err, status)
 		logOutgoingRequest(ctx, status)
 		return
 	}
 
+	if h.useAuth {
+		h.guard.succeed(ip)
+		endAttempt()
+		ok, retryAfter = h.limits.perCredential.allow(ctx.identity, time.Now())
+		if !ok {
+			status = http.StatusTooManyRequests
+			rateLimited.inc()
+			log.Warnw("Rate limited credential", "credential", ctx.identity, "requestId", ctx.id)
+			ctx.sendTooManyRequests(retryAfter)
+			logOutgoingRequest(ctx, status)
+			return
+		}
+	}
+
 	status, err = h.handle(ctx)
 
 	if err != nil {
@@ -148,22 +342,37 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logOutgoingRequest(ctx, status)
 }
 
-func (h *handler) authenticate(r *http.Request) error {
+// authenticate returns the identity of a verified client certificate, or checks
+// the deploy token of a request against the credentials and returns the name of
+// the one it matches.
+func (h *handler) authenticate(r *http.Request) (string, error) {
 	if !h.useAuth {
-		return nil
+		return "", nil
 	}
 
-	token := r.Header.Get(tokenHeader)
-	hash, err := deriveKey(token, h.authKey)
+	if identity, ok := h.certificateIdentity(r); ok {
+		return identity, nil
+	}
+
+	release, err := h.guard.acquire()
 	if err != nil {
-		return errInternalError
+		return "", err
 	}
+	defer release()
+
+	token := r.Header.Get(tokenHeader)
+	for _, c := range h.credentials {
+		hash, err := deriveKey(token, c.key)
+		if err != nil {
+			return "", errInternalError
+		}
 
-	if h.authKey.hash != hash {
-		return errUnauthorized
+		if c.key.hash == hash {
+			return c.name, nil
+		}
 	}
 
-	return nil
+	return "", errUnauthorized
 }
 
 func logIncommingRequest(ctx *Context) {
@@ -185,6 +394,10 @@ func assertMehthod(ctx *Context, method string, w http.ResponseWriter) error {
 }
 
 func (ctx *Context) sendJSON(v interface{}) (int, error) {
+	return ctx.sendJSONStatus(v, http.StatusOK)
+}
+
+func (ctx *Context) sendJSONStatus(v interface{}, status int) (int, error) {
 	r, err := json.Marshal(v)
 	if err != nil {
 		return http.StatusInternalServerError, err
@@ -192,9 +405,9 @@ func (ctx *Context) sendJSON(v interface{}) (int, error) {
 
 	ctx.w.Header().Set(requestIDHeader, ctx.id)
 	ctx.w.Header().Set(contentTypeHeader, "application/json")
-	ctx.w.WriteHeader(http.StatusOK)
+	ctx.w.WriteHeader(status)
 	ctx.w.Write(r)
-	return http.StatusOK, nil
+	return status, nil
 }
 
 func (ctx *Context) sendError(err error, status int) {
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+)
+
+// Job statuses.
+const (
+	jobRunning    = "running"
+	jobSucceeded  = "succeeded"
+	jobFailed     = "failed"
+	jobRolledBack = "rolled_back"
+)
+
+// Job record of a single redeployment of a target.
+type Job struct {
+	ID       string `json:"id"`
+	Target   string `json:"target"`
+	Image    string `json:"image"`
+	Tag      string `json:"tag,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Previous string `json:"previous,omitempty"`
+	Status   string `json:"status"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	TriggeredBy string `json:"triggeredBy,omitempty"`
+	ApprovedBy  string `json:"approvedBy,omitempty"`
+
+	Hooks    []HookResult       `json:"hooks,omitempty"`
+	OneOffs  []OneOffResult     `json:"oneOffs,omitempty"`
+	Probes   []ProbeResult      `json:"probes,omitempty"`
+	Captured *CapturedContainer `json:"-"`
+
+	Diagnostics *ContainerDiagnostics `json:"diagnostics,omitempty"`
+	Retention   *RetentionResult      `json:"retention,omitempty"`
+
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+func newJob(ctx *Context, target Target, image string) *Job {
+	ref, _ := parseImageRef(image)
+	return &Job{
+		ID:          ctx.id,
+		Target:      target.ID,
+		Image:       image,
+		Tag:         ref.tag,
+		Digest:      ref.digest,
+		Status:      jobRunning,
+		TriggeredBy: ctx.identity,
+		ApprovedBy:  ctx.approver,
+		Started:     time.Now().UTC(),
+	}
+}
+
+func (j *Job) fail(err error) {
+	j.Status = jobFailed
+	j.Error = secrets.redact(err.Error())
+}
+
+// setOutput records the output of a deployment with any known secrets removed.
+func (j *Job) setOutput(output string) {
+	j.Output = secrets.redact(output)
+}
+
+func (j *Job) finish() {
+	if j.Status == jobRunning {
+		j.Status = jobSucceeded
+	}
+	j.Finished = time.Now().UTC()
+}
+
+// env returns the environment variables describing the deployment which are
+// passed to deployment scripts.
+func (j *Job) env() []string {
+	ref, _ := parseImageRef(j.Image)
+	return []string{
+		"REDEPLOYER_REQUEST_ID=" + j.ID,
+		"REDEPLOYER_TARGET=" + j.Target,
+		"REDEPLOYER_IMAGE=" + j.Image,
+		"REDEPLOYER_REPOSITORY=" + ref.name,
+		"REDEPLOYER_TAG=" + j.Tag,
+		"REDEPLOYER_DIGEST=" + j.Digest,
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	typeKubernetes = "kubernetes"
+
+	serviceAccountDir     = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultRolloutTimeout = 5 * time.Minute
+	rolloutPollInterval   = 2 * time.Second
+)
+
+var (
+	errRolloutFailed    = fmt.Errorf("Rollout failed")
+	errRolloutTimeout   = fmt.Errorf("Rollout timed out")
+	errNoSuchDeployment = fmt.Errorf("No such deployment")
+	errInvalidKubecfg   = fmt.Errorf("Invalid kubeconfig")
+)
+
+// Kubernetes identifies a container in a Deployment. The API server is reached
+// using the kubeconfig if one is set, and in-cluster credentials otherwise.
+type Kubernetes struct {
+	Kubeconfig string        `yaml:"kubeconfig,omitempty"`
+	Context    string        `yaml:"context,omitempty"`
+	Namespace  string        `yaml:"namespace,omitempty"`
+	Deployment string        `yaml:"deployment,omitempty"`
+	Container  string        `yaml:"container,omitempty"`
+	Timeout    time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (k Kubernetes) validate() error {
+	if k.Namespace == "" || k.Deployment == "" || k.Container == "" {
+		return fmt.Errorf("kubernetes targets require namespace, deployment and container")
+	}
+	return nil
+}
+
+// kubeClient minimal client for the kubernetes API server.
+type kubeClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+// kubeDeployment the parts of an apps/v1 Deployment used by redeployer.
+type kubeDeployment struct {
+	Metadata struct {
+		Generation int64 `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Replicas *int32 `json:"replicas"`
+		Template struct {
+			Spec struct {
+				Containers []struct {
+					Name  string `json:"name"`
+					Image string `json:"image"`
+				} `json:"containers"`
+			} `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+	Status struct {
+		ObservedGeneration  int64 `json:"observedGeneration"`
+		Replicas            int32 `json:"replicas"`
+		UpdatedReplicas     int32 `json:"updatedReplicas"`
+		AvailableReplicas   int32 `json:"availableReplicas"`
+		UnavailableReplicas int32 `json:"unavailableReplicas"`
+		Conditions          []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+func (d kubeDeployment) image(container string) (string, bool) {
+	for _, c := range d.Spec.Template.Spec.Containers {
+		if c.Name == container {
+			return c.Image, true
+		}
+	}
+	return "", false
+}
+
+// rolloutDone reports whether a rollout has completed, and returns an error if it
+// can no longer complete. It follows the logic of kubectl rollout status.
+func (d kubeDeployment) rolloutDone() (bool, error) {
+	if d.Status.ObservedGeneration < d.Metadata.Generation {
+		return false, nil
+	}
+
+	for _, c := range d.Status.Conditions {
+		if c.Type == "Progressing" && c.Reason == "ProgressDeadlineExceeded" {
+			return false, fmt.Errorf("%s: %s", errRolloutFailed, c.Message)
+		}
+	}
+
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+
+	done := d.Status.UpdatedReplicas >= replicas &&
+		d.Status.Replicas <= d.Status.UpdatedReplicas &&
+		d.Status.AvailableReplicas >= d.Status.UpdatedReplicas
+	return done, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+func newKubeClient(cfg Kubernetes) (*kubeClient, error) {
+	if cfg.Kubeconfig == "" {
+		return newInClusterClient()
+	}
+
+	raw, err := ioutil.ReadFile(cfg.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var kc kubeconfig
+	err = yaml.Unmarshal(raw, &kc)
+	if err != nil {
+		return nil, err
+	}
+
+	name := cfg.Context
+	if name == "" {
+		name = kc.CurrentContext
+	}
+
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == name {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: no context %q", errInvalidKubecfg, name)
+	}
+
+	tlsConfig := &tls.Config{}
+	client := &kubeClient{}
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+
+		client.server = c.Cluster.Server
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := dataOrFile(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("%s: invalid certificate authority", errInvalidKubecfg)
+			}
+		}
+	}
+	if client.server == "" {
+		return nil, fmt.Errorf("%s: no cluster %q", errInvalidKubecfg, clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+
+		client.token = u.User.Token
+		if u.User.TokenFile != "" {
+			token, err := ioutil.ReadFile(u.User.TokenFile)
+			if err != nil {
+				return nil, err
+			}
+			client.token = string(bytes.TrimSpace(token))
+		}
+
+		cert, err := dataOrFile(u.User.ClientCertificateData, u.User.ClientCertificate)
+		if err != nil {
+			return nil, err
+		}
+		key, err := dataOrFile(u.User.ClientKeyData, u.User.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	client.client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return client, nil
+}
+
+func newInClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster and no kubeconfig configured")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	return &kubeClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		token:  string(bytes.TrimSpace(token)),
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func dataOrFile(data, path string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path != "" {
+		return ioutil.ReadFile(path)
+	}
+	return nil, nil
+}
+
+func (c *kubeClient) deploymentURL(namespace, name string) string {
+	return fmt.Sprintf("%s/apis/apps/v1/namespaces/%s/deployments/%s", c.server, namespace, name)
+}
+
+func (c *kubeClient) getDeployment(ctx *Context, namespace, name string) (kubeDeployment, error) {
+	var d kubeDeployment
+	err := c.do(ctx, http.MethodGet, c.deploymentURL(namespace, name), "", nil, &d)
+	return d, err
+}
+
+// setImage patches the image of a container in a Deployment, which starts a rollout.
+func (c *kubeClient) setImage(ctx *Context, namespace, name, container, image string) error {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []map[string]string{
+						{"name": container, "image": image},
+					},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	contentType := "application/strategic-merge-patch+json"
+	return c.do(ctx, http.MethodPatch, c.deploymentURL(namespace, name), contentType, body, nil)
+}
+
+func (c *kubeClient) do(ctx *Context, method, u, contentType string, body []byte, v interface{}) error {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set(contentTypeHeader, contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errNoSuchDeployment
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		log.Errorw("Kubernetes API request failed", "method", method, "url", u, "status", res.StatusCode, "response", string(msg), "requestId", ctx.id)
+		return fmt.Errorf("Kubernetes API request failed: %s", res.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (e *env) redeployKubernetes(ctx *Context, target Target, job *Job) {
+	cfg := *target.Kubernetes
+	client, ok := e.kube[target.ID]
+	if !ok {
+		job.fail(errInternalError)
+		log.Errorw("No kubernetes client for target", "service", target.ID, "requestId", ctx.id)
+		return
+	}
+
+	image, err := e.verifiedImage(ctx, target, job)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+
+	d, err := client.getDeployment(ctx, cfg.Namespace, cfg.Deployment)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+
+	previous, ok := d.image(cfg.Container)
+	if !ok {
+		job.fail(fmt.Errorf("No container %q in deployment", cfg.Container))
+		return
+	}
+	job.Previous = previous
+
+	err = client.setImage(ctx, cfg.Namespace, cfg.Deployment, cfg.Container, image)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+
+	err = e.waitForRollout(ctx, client, cfg)
+	if err != nil {
+		job.fail(err)
+		log.Errorw("Rollout did not complete", "deployment", cfg.Deployment, "error", err, "requestId", ctx.id)
+	}
+}
+
+func (e *env) waitForRollout(ctx *Context, client *kubeClient, cfg Kubernetes) error {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultRolloutTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		d, err := client.getDeployment(ctx, cfg.Namespace, cfg.Deployment)
+		if err != nil {
+			return err
+		}
+
+		done, err := d.rolloutDone()
+		if err != nil || done {
+			return err
+		}
+
+		log.Debugw("Waiting for rollout", "deployment", cfg.Deployment, "updated", d.Status.UpdatedReplicas, "available", d.Status.AvailableReplicas, "requestId", ctx.id)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(rolloutPollInterval):
+		}
+	}
+
+	return errRolloutTimeout
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAPIServer serves a single Deployment and completes or fails rollouts
+// started by patching it.
+type fakeAPIServer struct {
+	server      *httptest.Server
+	mu          sync.Mutex
+	image       string
+	generation  int64
+	failRollout bool
+	patches     []string
+}
+
+func newFakeAPIServer(image string) *fakeAPIServer {
+	api := &fakeAPIServer{image: image, generation: 1}
+	api.server = httptest.NewTLSServer(http.HandlerFunc(api.handle))
+	return api
+}
+
+func (api *fakeAPIServer) handle(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path != "/apis/apps/v1/namespaces/default/deployments/svc" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		body, _ := ioutil.ReadAll(r.Body)
+		api.patches = append(api.patches, r.Header.Get(contentTypeHeader)+" "+string(body))
+
+		var patch struct {
+			Spec struct {
+				Template struct {
+					Spec struct {
+						Containers []struct {
+							Image string `json:"image"`
+						} `json:"containers"`
+					} `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+		}
+		json.Unmarshal(body, &patch)
+		api.image = patch.Spec.Template.Spec.Containers[0].Image
+		api.generation++
+	case http.MethodGet:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	conditions := `[{"type":"Available","status":"True"}]`
+	if api.failRollout && len(api.patches) > 0 {
+		conditions = `[{"type":"Progressing","status":"False","reason":"ProgressDeadlineExceeded","message":"ReplicaSet \"svc-2\" has timed out progressing."}]`
+	}
+
+	fmt.Fprintf(w, `{
+		"metadata": {"name": "svc", "generation": %d},
+		"spec": {
+			"replicas": 2,
+			"template": {"spec": {"containers": [{"name": "sidecar", "image": "proxy:1.0"}, {"name": "svc", "image": "%s"}]}}
+		},
+		"status": {"observedGeneration": %d, "replicas": 2, "updatedReplicas": 2, "availableReplicas": 2, "conditions": %s}
+	}`, api.generation, api.image, api.generation, conditions)
+}
+
+func (api *fakeAPIServer) kubeconfig(t *testing.T, dir string) string {
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: api.server.Certificate().Raw})
+	content := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+- name: test-cluster
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+users:
+- name: test-user
+  user:
+    token: test-token
+contexts:
+- name: test
+  context:
+    cluster: test-cluster
+    user: test-user
+    namespace: default
+`, api.server.URL, base64.StdEncoding.EncodeToString(ca))
+
+	path := filepath.Join(dir, "kubeconfig")
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRedeployKubernetes(t *testing.T) {
+	assert := assert.New(t)
+	api := newFakeAPIServer("repository/svc:1.0")
+	defer api.server.Close()
+
+	dir, err := ioutil.TempDir("", "redeployer-kubernetes")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cfg := Kubernetes{
+		Kubeconfig: api.kubeconfig(t, dir),
+		Namespace:  "default",
+		Deployment: "svc",
+		Container:  "svc",
+	}
+	target := Target{
+		ID:         "test-svc",
+		Type:       typeKubernetes,
+		Kubernetes: &cfg,
+	}
+
+	client, err := newKubeClient(cfg)
+	assert.NoError(err)
+	e := &env{kube: map[string]*kubeClient{target.ID: client}}
+
+	current, err := e.currentImage(newTestContext(), target)
+	assert.NoError(err)
+	assert.Equal("repository/svc:1.0", current)
+
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	e.redeployKubernetes(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Equal("repository/svc:1.0", job.Previous)
+	assert.Equal("repository/svc:1.1", api.image)
+	assert.Len(api.patches, 1)
+	assert.Equal(`application/strategic-merge-patch+json {"spec":{"template":{"spec":{"containers":[{"image":"repository/svc:1.1","name":"svc"}]}}}}`, api.patches[0])
+
+	api.failRollout = true
+	job = newJob(newTestContext(), target, "repository/svc:1.2")
+	e.redeployKubernetes(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal("repository/svc:1.1", job.Previous)
+	assert.Contains(job.Error, "has timed out progressing")
+
+	missing := cfg
+	missing.Container = "missing"
+	target.Kubernetes = &missing
+	job = newJob(newTestContext(), target, "repository/svc:1.3")
+	e.redeployKubernetes(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Len(api.patches, 2)
+}
+
+func TestRolloutDone(t *testing.T) {
+	assert := assert.New(t)
+
+	var d kubeDeployment
+	replicas := int32(3)
+	d.Spec.Replicas = &replicas
+	d.Metadata.Generation = 2
+	d.Status.ObservedGeneration = 1
+
+	done, err := d.rolloutDone()
+	assert.NoError(err)
+	assert.False(done)
+
+	d.Status.ObservedGeneration = 2
+	d.Status.Replicas = 4
+	d.Status.UpdatedReplicas = 3
+	d.Status.AvailableReplicas = 3
+	done, err = d.rolloutDone()
+	assert.NoError(err)
+	assert.False(done)
+
+	d.Status.Replicas = 3
+	done, err = d.rolloutDone()
+	assert.NoError(err)
+	assert.True(done)
+}
+
+func TestNewKubeClient_invalid(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "redeployer-kubernetes")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kubeconfig")
+	assert.NoError(ioutil.WriteFile(path, []byte("current-context: missing\n"), 0600))
+
+	_, err = newKubeClient(Kubernetes{Kubeconfig: path})
+	assert.Error(err)
+}
+
+func TestRedeployKubernetes_signature(t *testing.T) {
+	assert := assert.New(t)
+	reg := newTestRegistry()
+	defer reg.server.Close()
+	api := newFakeAPIServer("repository/svc:1.0")
+	defer api.server.Close()
+
+	dir, err := ioutil.TempDir("", "redeployer-kubernetes")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	signed := manifest{MediaType: mediaTypeOCIManifest}
+	unsigned := manifest{MediaType: mediaTypeOCIManifest, Layers: []descriptor{{Digest: "sha256:abc"}}}
+	reg.addManifest("repository/svc", "1.1", signed)
+	reg.addManifest("repository/svc", "1.2", unsigned)
+	raw, _ := json.Marshal(signed)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(raw))
+
+	key, keyPath := createTestKey(t, dir, "trusted.pub")
+	addTestSignature(reg, "repository/svc", digest, digest, key)
+
+	cfg := Kubernetes{
+		Kubeconfig: api.kubeconfig(t, dir),
+		Namespace:  "default",
+		Deployment: "svc",
+		Container:  "svc",
+	}
+	target := Target{
+		ID:         "test-svc",
+		Type:       typeKubernetes,
+		Kubernetes: &cfg,
+		Signature:  &SignaturePolicy{PublicKeys: []string{keyPath}},
+	}
+
+	client, err := newKubeClient(cfg)
+	assert.NoError(err)
+	e := &env{
+		kube:     map[string]*kubeClient{target.ID: client},
+		registry: reg.client(),
+	}
+
+	job := newJob(newTestContext(), target, reg.host()+"/repository/svc:1.1")
+	e.redeployKubernetes(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Equal(digest, job.Digest)
+	assert.Equal(reg.host()+"/repository/svc@"+digest, api.image)
+
+	job = newJob(newTestContext(), target, reg.host()+"/repository/svc:1.2")
+	e.redeployKubernetes(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal(errImageNotVerified.Error(), job.Error)
+	assert.Len(api.patches, 1)
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	stdLog "log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
@@ -21,18 +26,34 @@ var (
 )
 
 type env struct {
-	cfg    Config
-	docker DockerClient
+	cfg       Config
+	docker    DockerClient
+	registry  *registryClient
+	proxies   map[string]*blueGreenProxy
+	systemd   ServiceManager
+	kube      map[string]*kubeClient
+	approvals *approvalStore
+
+	mu          sync.Mutex
+	lastSuccess map[string]time.Time
+	started     map[string]time.Time
+	queued      map[string]queuedDeployment
 }
 
 func main() {
 	flag.Parse()
 
 	env := newEnv()
+	env.startProxies()
 	server := newServer(env, *port)
 
-	log.Infow("Starting redeployer service", "port", port)
-	err := server.ListenAndServe()
+	log.Infow("Starting redeployer service", "port", port, "tls", server.TLSConfig != nil)
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		log.Errorw("Service failed", "error", err)
 	}
@@ -52,6 +73,20 @@ func (e *env) triggerRedeployment(ctx *Context) (int, error) {
 		return status, err
 	}
 
+	if target.RequiresApproval {
+		return e.requestApproval(ctx, target, req)
+	}
+
+	if status == http.StatusAccepted {
+		go e.redeployAfterFreeze(ctx, target, req.Image)
+		return ctx.sendJSONStatus(ResponseMessage{
+			Message: "Redeployment queued until freeze ends",
+		}, http.StatusAccepted)
+	}
+
+	if wait := e.reserveMinInterval(target, time.Now()); wait > 0 {
+		return e.rejectTooRecent(ctx, target, wait)
+	}
 	go e.redeploy(ctx, target, req.Image)
 
 	ctx.sendJSON(ResponseMessage{
@@ -67,48 +102,246 @@ func (e *env) findTarget(ctx *Context, req RedeploymentRequest) (Target, int, er
 		return target, http.StatusNotFound, errNotFound
 	}
 
+	status, err := e.checkTargetAllowlist(ctx, target)
+	if err != nil {
+		return target, status, err
+	}
+
+	if !target.allowsIdentity(ctx.identity) {
+		log.Warnw("Identity not allowed to deploy target", "identity", ctx.identity, "service", target.ID, "requestId", ctx.id)
+		return target, http.StatusForbidden, errForbidden
+	}
+
+	status, err = e.checkPolicies(ctx, target, req.Image)
+	if err != nil {
+		return target, status, err
+	}
+
+	if wait := e.checkMinInterval(target, time.Now()); wait > 0 {
+		status, err = e.rejectTooRecent(ctx, target, wait)
+		return target, status, err
+	}
+
+	status, err = e.checkFreeze(ctx, target, req)
+	return target, status, err
+}
+
+// checkPolicies verifies that an image may be deployed to a target.
+func (e *env) checkPolicies(ctx *Context, target Target, image string) (int, error) {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		log.Warnw("Invalid image reference", "image", image, "requestId", ctx.id)
+		return http.StatusBadRequest, errBadRequest
+	}
+
+	if target.RequireDigest && ref.digest == "" {
+		log.Warnw("Image not referenced by digest", "image", image, "service", target.ID, "requestId", ctx.id)
+		return http.StatusForbidden, fmt.Errorf("%s: target requires an image referenced by digest", errForbidden)
+	}
+
 	pattern, err := regexp.Compile(target.MustMatch)
 	if err != nil {
 		log.Errorw("Failed to compile regex", "service", target.ID, "error", err, "requestId", ctx.id)
-		return target, http.StatusInternalServerError, errInternalError
+		return http.StatusInternalServerError, errInternalError
 	}
 
-	ok = pattern.MatchString(req.Image)
-	if !ok {
-		log.Warnw("Image did not match target", "image", req.Image, "regex", target.MustMatch, "requestId", ctx.id)
-		return target, http.StatusForbidden, errForbidden
+	if !pattern.MatchString(image) {
+		log.Warnw("Image did not match target", "image", image, "regex", target.MustMatch, "requestId", ctx.id)
+		return http.StatusForbidden, errForbidden
+	}
+
+	if target.VersionPolicy != nil {
+		return e.checkVersionPolicy(ctx, target, image)
 	}
 
-	return target, http.StatusOK, nil
+	return http.StatusOK, nil
+}
+
+// checkVersionPolicy verifies that an image satisfies the version policy of a
+// target. The version is checked against the constraint before the running
+// version is looked up, which is only needed to deny downgrades. Failing to
+// determine the running version is an internal error rather than a policy
+// violation.
+func (e *env) checkVersionPolicy(ctx *Context, target Target, image string) (int, error) {
+	policy := *target.VersionPolicy
+	version, err := targetVersion(target, image)
+	if err == nil {
+		err = policy.allows(version)
+	}
+	if err != nil {
+		log.Warnw("Image violates version policy", "image", image, "reason", err, "requestId", ctx.id)
+		return http.StatusForbidden, fmt.Errorf("%s: %s", errForbidden, err)
+	}
+
+	if !policy.DenyDowngrade {
+		return http.StatusOK, nil
+	}
+
+	previous, err := e.currentImage(ctx, target)
+	if err != nil && err != errNoSuchContainer {
+		log.Errorw("Failed to determine running version", "service", target.ID, "error", err, "requestId", ctx.id)
+		return http.StatusInternalServerError, errInternalError
+	}
+
+	current := ""
+	if previous != "" {
+		current, err = targetVersion(target, previous)
+		if err != nil {
+			log.Warnw("Running version is unknown, skipping downgrade check", "service", target.ID, "image", previous, "requestId", ctx.id)
+		}
+	}
+
+	err = policy.checkDowngrade(version, current)
+	if err != nil {
+		log.Warnw("Image violates version policy", "image", image, "reason", err, "requestId", ctx.id)
+		return http.StatusForbidden, fmt.Errorf("%s: %s", errForbidden, err)
+	}
+
+	return http.StatusOK, nil
+}
+
+// targetVersion returns the version of an image that version policies apply to,
+// which is the release itself for systemd targets and the tag for images. An
+// image referenced only by digest carries no version.
+func targetVersion(target Target, image string) (string, error) {
+	if target.Type == typeSystemd {
+		return image, nil
+	}
+
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return "", err
+	}
+	if ref.tag == "" && ref.digest != "" {
+		return "", fmt.Errorf("image %s is referenced only by digest, reference it as name:tag@digest", image)
+	}
+	return ref.tag, nil
+}
+
+// currentImage returns the image that a target is currently running.
+func (e *env) currentImage(ctx *Context, target Target) (string, error) {
+	switch target.Type {
+	case typeCompose:
+		return e.docker.ComposeImage(ctx, *target.Compose)
+	case typeSystemd:
+		release, err := os.Readlink(filepath.Join(target.Systemd.ReleaseDir, currentRelease))
+		if err != nil {
+			return "", errNoSuchContainer
+		}
+		return filepath.Base(release), nil
+	case typeKubernetes:
+		cfg := *target.Kubernetes
+		d, err := e.kube[target.ID].getDeployment(ctx, cfg.Namespace, cfg.Deployment)
+		if err != nil {
+			return "", err
+		}
+		image, _ := d.image(cfg.Container)
+		return image, nil
+	case typeSwarm:
+		return e.docker.ServiceImage(ctx, target.Swarm.Service)
+	default:
+		return e.docker.GetImageID(ctx, e.containerName(target))
+	}
 }
 
 func (e *env) redeploy(ctx *Context, target Target, image string) {
 	defer recoverFromPanic(ctx, "env.redeploy", false)
 
-	log.Debugw("Redeploying service", "service", target.ID, "image", image, "requestId", ctx.id)
-	previous, removeOld, err := e.prepareDeployment(ctx, target, image)
+	job := newJob(ctx, target, image)
+	redeployTotal.inc()
+	log.Debugw("Redeploying service", "service", target.ID, "image", image, "mode", target.Mode, "requestId", ctx.id)
+	err := runHooks(ctx, hookPreDeploy, target.PreDeploy, job)
+	if err != nil {
+		job.fail(err)
+		log.Errorw("Redeployment aborted", "error", err, "requestId", ctx.id)
+	} else {
+		e.deploy(ctx, target, job)
+	}
+
+	// Blue/green deployments are probed before traffic is switched.
+	if job.Status == jobRunning && target.Mode != modeBlueGreen {
+		err = e.runProbes(ctx, target, job)
+		if err != nil {
+			job.fail(err)
+			e.captureDiagnostics(ctx, target, job, e.containerName(target))
+		}
+	}
+
+	if job.Status == jobRunning {
+		err = runHooks(ctx, hookPostDeploy, target.PostDeploy, job)
+		if err != nil {
+			job.fail(err)
+		}
+	}
+
+	if job.Status == jobRunning && target.Retention != nil {
+		e.applyRetention(ctx, target, job)
+	}
+
+	job.finish()
+	if job.Status == jobSucceeded {
+		e.recordSuccess(target, job.Finished)
+	} else {
+		e.recordFailure(target)
+		redeployFailure.inc()
+	}
+	log.Infow("Redeployment finished", "job", job, "executionTime", ctx.latency(), "requestId", ctx.id)
+}
+
+// deploy rolls out the image of a job in the way configured for the target.
+func (e *env) deploy(ctx *Context, target Target, job *Job) {
+	switch {
+	case target.Type == typeCompose:
+		e.redeployCompose(ctx, target, job)
+	case target.Type == typeSystemd:
+		e.redeploySystemd(ctx, target, job)
+	case target.Type == typeKubernetes:
+		e.redeployKubernetes(ctx, target, job)
+	case target.Type == typeSwarm:
+		e.redeploySwarm(ctx, target, job)
+	case target.Mode == modeBlueGreen:
+		e.redeployBlueGreen(ctx, target, job)
+	default:
+		e.redeployContainer(ctx, target, job)
+	}
+}
+
+func (e *env) redeployContainer(ctx *Context, target Target, job *Job) {
+	previous, removeOld, err := e.prepareDeployment(ctx, target, job)
 	if err != nil {
-		log.Errorw("Redeployment failed", "requestId", ctx.id)
+		job.fail(err)
+		log.Errorw("Redeployment aborted", "error", err, "requestId", ctx.id)
+		return
 	}
+	job.Previous = previous
 
-	output, err := target.execute(ctx, image)
+	output, err := e.startTarget(ctx, target, job, target.ID, nil)
+	job.setOutput(output)
 	if err != nil {
+		job.fail(err)
 		log.Errorw("Failed to execute redeployment", "error", err, "output", output, "requestId", ctx.id)
+		e.captureDiagnostics(ctx, target, job, target.ID)
+		if target.recreates() && job.Captured != nil {
+			e.rollbackContainer(ctx, target, job, previous)
+		}
 	}
 	log.Infow(output, "requestId", ctx.id)
 
-	if removeOld && image != previous {
+	if removeOld && job.Image != previous && job.Status != jobRolledBack && target.Retention == nil {
 		e.docker.RemoveImage(ctx, previous)
 	}
-
-	log.Debugw("Redeployment succeded", "executionTime", ctx.latency(), "requestId", ctx.id)
 }
 
-func (e *env) prepareDeployment(ctx *Context, target Target, image string) (string, bool, error) {
+func (e *env) prepareDeployment(ctx *Context, target Target, job *Job) (string, bool, error) {
 	log.Debugw("Preparing redeployment", "requestId", ctx.id)
 	removeOld := true
 
-	err := e.docker.Pull(ctx, image)
+	err := e.pullImage(ctx, target, job)
+	if err != nil {
+		return "", removeOld, err
+	}
+
+	err = e.runOneOffs(ctx, target, job)
 	if err != nil {
 		return "", removeOld, err
 	}
@@ -121,24 +354,76 @@ func (e *env) prepareDeployment(ctx *Context, target Target, image string) (stri
 		return "", removeOld, err
 	}
 
+	if target.recreates() {
+		job.Captured, err = e.captureContainer(ctx, target.ID)
+		if err != nil {
+			log.Errorw("Failed to capture container configuration", "error", err, "requestId", ctx.id)
+			return "", removeOld, err
+		}
+	}
+
 	err = e.docker.RemoveContainer(ctx, target.ID)
 	return previous, removeOld, err
 }
 
+// pullImage pulls the image of a job if there is room for it, resolves its digest
+// and verifies its signature if required by the target.
+func (e *env) pullImage(ctx *Context, target Target, job *Job) error {
+	err := e.checkDiskSpace(ctx, target, job)
+	if err != nil {
+		return err
+	}
+
+	err = e.pull(ctx, target, job.Image)
+	if err != nil {
+		return err
+	}
+
+	if job.Digest == "" {
+		job.Digest, err = e.docker.GetDigest(ctx, job.Image)
+		if err != nil {
+			log.Warnw("Failed to resolve image digest", "image", job.Image, "error", err, "requestId", ctx.id)
+		}
+	}
+
+	if target.Signature != nil {
+		return e.verifySignature(ctx, *target.Signature, job.Image, job.Digest)
+	}
+
+	return nil
+}
+
 func checkHealth(ctx *Context) (int, error) {
 	ctx.sendOK()
 	return http.StatusOK, nil
 }
 
 func newServer(e *env, port int) *http.Server {
-	r := newRouter(e.cfg.Authentication)
+	r := newRouter(e.cfg)
 	r.GET("/health", checkHealth, false)
+	r.GET("/metrics", serveMetrics, true)
 	r.POST("/redeploy", e.triggerRedeployment, true)
+	r.POST("/deployments/", e.reviewDeployment, true)
+
+	err := r.checkRouteAllowlists()
+	if err != nil {
+		log.Fatalw("Invalid route allowlists", "error", err)
+	}
 
-	return &http.Server{
+	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
 		Handler: r,
 	}
+
+	if e.cfg.TLS != nil {
+		tlsConfig, err := e.cfg.TLS.config()
+		if err != nil {
+			log.Fatalw("Failed to configure TLS", "error", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	return server
 }
 
 func newEnv() *env {
@@ -153,17 +438,238 @@ func newEnv() *env {
 		log.Fatalw("Failed to parse config file", "error", err)
 	}
 
+	if cfg.DiskSpace != nil {
+		err = cfg.DiskSpace.validate()
+		if err != nil {
+			log.Fatalw("Invalid disk space guard", "error", err)
+		}
+	}
+
+	for _, window := range cfg.Freeze {
+		err = window.validate()
+		if err != nil {
+			log.Fatalw("Invalid freeze window", "freeze", window.Name, "error", err)
+		}
+	}
+
+	if cfg.RateLimits != nil {
+		for _, rate := range []*Rate{cfg.RateLimits.PerIP, cfg.RateLimits.PerCredential} {
+			if rate == nil {
+				continue
+			}
+			err = rate.validate()
+			if err != nil {
+				log.Fatalw("Invalid rate limit", "error", err)
+			}
+		}
+	}
+
+	proxies := make(map[string]*blueGreenProxy)
+	kube := make(map[string]*kubeClient)
+	identities := identityNames(cfg)
+	for _, identity := range cfg.FreezeOverrideIdentities {
+		if !identities[identity] {
+			log.Fatalw("Unknown identity allowed to override freezes", "identity", identity)
+		}
+	}
 	for _, target := range cfg.Services {
 		_, err = regexp.Compile(target.MustMatch)
 		if err != nil {
 			msg := fmt.Sprintf("Invalid regex [%s] for target: %s", target.MustMatch, target.ID)
 			log.Fatalw(msg, "error", err)
 		}
+
+		if target.VersionPolicy != nil {
+			err = target.VersionPolicy.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid version policy for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		}
+
+		switch target.Type {
+		case "", typeDocker:
+		case typeCompose:
+			if target.Compose == nil {
+				log.Fatalw("Missing compose configuration", "service", target.ID)
+			}
+			err = target.Compose.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid compose configuration for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		case typeSystemd:
+			if target.Systemd == nil {
+				log.Fatalw("Missing systemd configuration", "service", target.ID)
+			}
+			err = target.Systemd.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid systemd configuration for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+			if target.Signature != nil || target.RequireDigest {
+				log.Fatalw("Systemd targets do not support signature or requireDigest, artifacts are verified with checksumUrl", "service", target.ID)
+			}
+		case typeKubernetes:
+			if target.Kubernetes == nil {
+				log.Fatalw("Missing kubernetes configuration", "service", target.ID)
+			}
+			err = target.Kubernetes.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid kubernetes configuration for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+			kube[target.ID], err = newKubeClient(*target.Kubernetes)
+			if err != nil {
+				msg := fmt.Sprintf("Failed to create kubernetes client for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		case typeSwarm:
+			if target.Swarm == nil {
+				log.Fatalw("Missing swarm configuration", "service", target.ID)
+			}
+			err = target.Swarm.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid swarm configuration for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		default:
+			log.Fatalw("Unknown target type", "service", target.ID, "type", target.Type)
+		}
+
+		switch target.Mode {
+		case "", modeRecreate:
+		case modeBlueGreen:
+			if target.BlueGreen == nil {
+				log.Fatalw("Missing blue/green configuration", "service", target.ID)
+			}
+			err = target.BlueGreen.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid blue/green configuration for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+			if target.recreates() {
+				log.Fatalw("Blue/green targets require a script or a container spec", "service", target.ID)
+			}
+			if target.Container != nil && target.BlueGreen.ContainerPort == 0 {
+				log.Fatalw("Blue/green targets with a container spec require containerPort", "service", target.ID)
+			}
+			proxies[target.ID] = newBlueGreenProxy(target)
+		default:
+			log.Fatalw("Unknown deployment mode", "service", target.ID, "mode", target.Mode)
+		}
+
+		if target.Container != nil {
+			err = target.Container.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid container spec for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		}
+
+		if len(target.RunBefore) > 0 && target.Type != "" && target.Type != typeDocker && target.Type != typeCompose {
+			log.Fatalw("One-off containers are only supported for docker and compose targets", "service", target.ID)
+		}
+		for _, oneOff := range target.RunBefore {
+			err = oneOff.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid one-off container for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		}
+
+		for _, probe := range target.Probes {
+			err = probe.validate(target)
+			if err != nil {
+				msg := fmt.Sprintf("Invalid probe for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		}
+
+		for _, hook := range append(target.PreDeploy, target.PostDeploy...) {
+			err = hook.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid deployment hook for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		}
+
+		if target.Retention != nil {
+			if target.Type != "" && target.Type != typeDocker && target.Type != typeCompose {
+				log.Fatalw("Retention policies are only supported for docker and compose targets", "service", target.ID)
+			}
+			err = target.Retention.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid retention policy for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		}
+
+		if target.RequiresApproval && len(identities) < 2 {
+			log.Fatalw("Targets requiring approval need at least two credentials", "service", target.ID)
+		}
+
+		for _, identity := range target.AllowedIdentities {
+			if !identities[identity] {
+				log.Fatalw("Unknown identity allowed for target", "service", target.ID, "identity", identity)
+			}
+		}
+
+		_, err = parseAllowlist(target.AllowedIPs)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid allowlist for target: %s", target.ID)
+			log.Fatalw(msg, "error", err)
+		}
+
+		for _, window := range target.Freeze {
+			err = window.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid freeze window for target: %s", target.ID)
+				log.Fatalw(msg, "freeze", window.Name, "error", err)
+			}
+		}
+
+		if target.Pull != nil {
+			err = target.Pull.validate()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid pull policy for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		}
+
+		if target.Signature != nil {
+			_, err = target.Signature.loadKeys()
+			if err != nil {
+				msg := fmt.Sprintf("Invalid signature public keys for target: %s", target.ID)
+				log.Fatalw(msg, "error", err)
+			}
+		}
 	}
 
+	credentials := newCredentialStore(cfg)
 	return &env{
-		cfg:    cfg,
-		docker: &cliDockerClient{},
+		cfg:       cfg,
+		docker:    &cliDockerClient{api: newDockerAPI(), credentials: credentials},
+		registry:  newRegistryClient(credentials),
+		proxies:   proxies,
+		systemd:   &systemctlClient{},
+		kube:      kube,
+		approvals: newApprovalStore(),
+	}
+}
+
+// startProxies restores the state of blue/green targets and starts proxying
+// traffic to them.
+func (e *env) startProxies() {
+	ctx := &Context{
+		id:      "startup",
+		start:   time.Now(),
+		Context: context.Background(),
+	}
+
+	for _, proxy := range e.proxies {
+		proxy.restore(ctx, e.docker)
+		go proxy.listen()
 	}
 }
 
@@ -171,7 +677,7 @@ func getLogger() *zap.SugaredLogger {
 	cfg := zap.NewProductionConfig()
 	cfg.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
 
-	logger, err := cfg.Build()
+	logger, err := cfg.Build(zap.WrapCore(newRedactingCore))
 	if err != nil {
 		stdLog.Fatalf("Failed to create logger. Error: %s", err)
 		return nil
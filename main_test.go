@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -54,6 +56,7 @@ func TestRedeploy_ok(t *testing.T) {
 
 	time.Sleep(200 * time.Millisecond)
 	assert.Equal("repository/svc:1.1", dc.PullArg)
+	assert.Equal("repository/svc:1.1", dc.GetDigestArg)
 	assert.Equal("test-svc", dc.GetImageIDArg)
 	assert.Equal("test-svc", dc.RemoveContainerArg)
 	assert.Equal("repository/svc:1.0", dc.RemoveImageArg)
@@ -151,6 +154,186 @@ func TestRedeploy_notOk(t *testing.T) {
 	assert.Equal(http.StatusForbidden, resForbidden3.Code)
 }
 
+func TestRedeploy_versionPolicy(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+
+	dc := &mockDockerClient{
+		GetImageIDOutput: "repository/svc:1.4.2",
+	}
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			Services: map[string]Target{
+				"test-svc": Target{
+					ID:        "test-svc",
+					Binary:    "/bin/sh",
+					Script:    "./resources/test-svc.sh",
+					MustMatch: "^repository/svc:.*",
+					VersionPolicy: &VersionPolicy{
+						Constraint:    "~1.4",
+						DenyDowngrade: true,
+					},
+				},
+			},
+		},
+		docker: dc,
+	}
+	server := newServer(e, 9000)
+
+	reqDowngrade := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.4.1",
+	})
+	reqDowngrade.Header.Set(tokenHeader, deployToken)
+	resDowngrade := performTestRequest(server.Handler, reqDowngrade)
+	assert.Equal(http.StatusForbidden, resDowngrade.Code)
+
+	var body ResponseMessage
+	err := json.Unmarshal(resDowngrade.Body.Bytes(), &body)
+	assert.NoError(err)
+	assert.Equal("Forbidden: version 1.4.1 is a downgrade from the running version 1.4.2", body.Message)
+
+	reqMinor := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.5.0",
+	})
+	reqMinor.Header.Set(tokenHeader, deployToken)
+	resMinor := performTestRequest(server.Handler, reqMinor)
+	assert.Equal(http.StatusForbidden, resMinor.Code)
+
+	reqOk := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.4.3",
+	})
+	reqOk.Header.Set(tokenHeader, deployToken)
+	resOk := performTestRequest(server.Handler, reqOk)
+	assert.Equal(http.StatusOK, resOk.Code)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal("repository/svc:1.4.3", dc.PullArg)
+}
+
+func TestRedeploy_versionPolicyUnknownVersion(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			Services: map[string]Target{
+				"test-svc": Target{
+					ID:        "test-svc",
+					Binary:    "/bin/sh",
+					Script:    "./resources/test-svc.sh",
+					MustMatch: "^repository/svc[:@].*",
+					VersionPolicy: &VersionPolicy{
+						Constraint:    "~1.4",
+						DenyDowngrade: true,
+					},
+				},
+			},
+		},
+		docker: &mockDockerClient{
+			GetImageIDErr: fmt.Errorf("docker unavailable"),
+		},
+	}
+	server := newServer(e, 9000)
+
+	req := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.4.3",
+	})
+	req.Header.Set(tokenHeader, deployToken)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusInternalServerError, res.Code)
+
+	reqConstraint := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.5.0",
+	})
+	reqConstraint.Header.Set(tokenHeader, deployToken)
+	resConstraint := performTestRequest(server.Handler, reqConstraint)
+	assert.Equal(http.StatusForbidden, resConstraint.Code)
+
+	reqDigest := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc@sha256:4b0a2a4b3c9e3fbd1c2bd0f1d7c7e8a84cfb02e8e9bdc5a2e6d7a4ad7fbbf0c4",
+	})
+	reqDigest.Header.Set(tokenHeader, deployToken)
+	resDigest := performTestRequest(server.Handler, reqDigest)
+	assert.Equal(http.StatusForbidden, resDigest.Code)
+
+	var body ResponseMessage
+	err := json.Unmarshal(resDigest.Body.Bytes(), &body)
+	assert.NoError(err)
+	assert.Contains(body.Message, "referenced only by digest")
+}
+
+func TestRedeploy_requireDigest(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+	digest := "sha256:4b0a2a4b3c9e3fbd1c2bd0f1d7c7e8a84cfb02e8e9bdc5a2e6d7a4ad7fbbf0c4"
+
+	dc := &mockDockerClient{
+		GetImageIDOutput: "repository/svc:1.0",
+	}
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			Services: map[string]Target{
+				"test-svc": Target{
+					ID:            "test-svc",
+					Binary:        "/bin/sh",
+					Script:        "./resources/test-svc.sh",
+					MustMatch:     "^repository/svc[:@].*",
+					RequireDigest: true,
+				},
+			},
+		},
+		docker: dc,
+	}
+	server := newServer(e, 9000)
+
+	reqTag := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.1",
+	})
+	reqTag.Header.Set(tokenHeader, deployToken)
+	resTag := performTestRequest(server.Handler, reqTag)
+	assert.Equal(http.StatusForbidden, resTag.Code)
+
+	reqInvalid := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc@sha256:123",
+	})
+	reqInvalid.Header.Set(tokenHeader, deployToken)
+	resInvalid := performTestRequest(server.Handler, reqInvalid)
+	assert.Equal(http.StatusBadRequest, resInvalid.Code)
+
+	reqDigest := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc@" + digest,
+	})
+	reqDigest.Header.Set(tokenHeader, deployToken)
+	resDigest := performTestRequest(server.Handler, reqDigest)
+	assert.Equal(http.StatusOK, resDigest.Code)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal("repository/svc@"+digest, dc.PullArg)
+	assert.Equal("", dc.GetDigestArg)
+	assert.Equal("test-svc", dc.RemoveContainerArg)
+}
+
 func TestHealth(t *testing.T) {
 	assert := assert.New(t)
 
@@ -178,6 +361,10 @@ type mockDockerClient struct {
 	PullArg string
 	PullErr error
 
+	GetDigestArg    string
+	GetDigestOutput string
+	GetDigestErr    error
+
 	GetImageIDArg    string
 	GetImageIDOutput string
 	GetImageIDErr    error
@@ -187,6 +374,72 @@ type mockDockerClient struct {
 
 	RemoveImageArg string
 	RemoveImageErr error
+
+	ListImagesArg    string
+	ListImagesOutput []ImageInfo
+	ListImagesErr    error
+
+	ImagesInUseOutput map[string]bool
+	ImagesInUseErr    error
+
+	RunContainerName   string
+	RunContainerImage  string
+	RunContainerSpec   ContainerSpec
+	RunContainerOutput string
+	RunContainerErr    error
+
+	RunOnceName     string
+	RunOnceImage    string
+	RunOnceSpec     ContainerSpec
+	RunOnceOutput   string
+	RunOnceExitCode int
+	RunOnceErr      error
+
+	ExecName   string
+	ExecCmd    []string
+	ExecOutput string
+	ExecErr    error
+
+	HealthStatuses  []string
+	HealthStatusErr error
+
+	ContainerLogsName   string
+	ContainerLogsLines  int
+	ContainerLogsOutput string
+	ContainerLogsErr    error
+
+	InspectContainerArg    string
+	InspectContainerOutput json.RawMessage
+	InspectContainerErr    error
+
+	InspectImageArg    string
+	InspectImageOutput json.RawMessage
+	InspectImageErr    error
+
+	CreateContainerName   string
+	CreateContainerConfig json.RawMessage
+	CreateContainerErr    error
+
+	ComposeImageArg    Compose
+	ComposeImageOutput string
+	ComposeImageErr    error
+
+	ComposeUpArg    Compose
+	ComposeUpImage  string
+	ComposeUpOutput string
+	ComposeUpErr    error
+
+	ServiceImageArg    string
+	ServiceImageOutput string
+	ServiceImageErr    error
+
+	UpdateServiceArg    Swarm
+	UpdateServiceImage  string
+	UpdateServiceOutput string
+	UpdateServiceErr    error
+
+	ServiceUpdates   []ServiceUpdateStatus
+	ServiceUpdateErr error
 }
 
 func (c *mockDockerClient) Pull(ctx *Context, image string) error {
@@ -194,6 +447,11 @@ func (c *mockDockerClient) Pull(ctx *Context, image string) error {
 	return c.PullErr
 }
 
+func (c *mockDockerClient) GetDigest(ctx *Context, image string) (string, error) {
+	c.GetDigestArg = image
+	return c.GetDigestOutput, c.GetDigestErr
+}
+
 func (c *mockDockerClient) GetImageID(ctx *Context, name string) (string, error) {
 	c.GetImageIDArg = name
 	return c.GetImageIDOutput, c.GetImageIDErr
@@ -209,10 +467,113 @@ func (c *mockDockerClient) RemoveImage(ctx *Context, image string) error {
 	return c.RemoveImageErr
 }
 
+func (c *mockDockerClient) ListImages(ctx *Context, repository string) ([]ImageInfo, error) {
+	c.ListImagesArg = repository
+	return c.ListImagesOutput, c.ListImagesErr
+}
+
+func (c *mockDockerClient) ImagesInUse(ctx *Context) (map[string]bool, error) {
+	return c.ImagesInUseOutput, c.ImagesInUseErr
+}
+
+func (c *mockDockerClient) RunContainer(ctx *Context, name, image string, spec ContainerSpec) (string, error) {
+	c.RunContainerName = name
+	c.RunContainerImage = image
+	c.RunContainerSpec = spec
+	return c.RunContainerOutput, c.RunContainerErr
+}
+
+func (c *mockDockerClient) RunOnce(ctx *Context, name, image string, spec ContainerSpec) (string, int, error) {
+	c.RunOnceName = name
+	c.RunOnceImage = image
+	c.RunOnceSpec = spec
+	return c.RunOnceOutput, c.RunOnceExitCode, c.RunOnceErr
+}
+
+func (c *mockDockerClient) Exec(ctx *Context, name string, command []string) (string, error) {
+	c.ExecName = name
+	c.ExecCmd = command
+	return c.ExecOutput, c.ExecErr
+}
+
+// HealthStatus returns the configured statuses in order, repeating the last one.
+func (c *mockDockerClient) HealthStatus(ctx *Context, name string) (string, error) {
+	if len(c.HealthStatuses) == 0 {
+		return "", c.HealthStatusErr
+	}
+
+	status := c.HealthStatuses[0]
+	if len(c.HealthStatuses) > 1 {
+		c.HealthStatuses = c.HealthStatuses[1:]
+	}
+	return status, c.HealthStatusErr
+}
+
+func (c *mockDockerClient) ContainerLogs(ctx *Context, name string, lines int) (string, error) {
+	c.ContainerLogsName = name
+	c.ContainerLogsLines = lines
+	return c.ContainerLogsOutput, c.ContainerLogsErr
+}
+
+func (c *mockDockerClient) InspectContainer(ctx *Context, name string) (json.RawMessage, error) {
+	c.InspectContainerArg = name
+	return c.InspectContainerOutput, c.InspectContainerErr
+}
+
+func (c *mockDockerClient) InspectImage(ctx *Context, image string) (json.RawMessage, error) {
+	c.InspectImageArg = image
+	return c.InspectImageOutput, c.InspectImageErr
+}
+
+func (c *mockDockerClient) CreateContainer(ctx *Context, name string, config json.RawMessage) (string, error) {
+	c.CreateContainerName = name
+	c.CreateContainerConfig = config
+	return "", c.CreateContainerErr
+}
+
+func (c *mockDockerClient) ComposeImage(ctx *Context, cfg Compose) (string, error) {
+	c.ComposeImageArg = cfg
+	return c.ComposeImageOutput, c.ComposeImageErr
+}
+
+func (c *mockDockerClient) ComposeUp(ctx *Context, cfg Compose, image string) (string, error) {
+	c.ComposeUpArg = cfg
+	c.ComposeUpImage = image
+	return c.ComposeUpOutput, c.ComposeUpErr
+}
+
+func (c *mockDockerClient) ServiceImage(ctx *Context, name string) (string, error) {
+	c.ServiceImageArg = name
+	return c.ServiceImageOutput, c.ServiceImageErr
+}
+
+func (c *mockDockerClient) UpdateService(ctx *Context, cfg Swarm, image string) (string, error) {
+	c.UpdateServiceArg = cfg
+	c.UpdateServiceImage = image
+	return c.UpdateServiceOutput, c.UpdateServiceErr
+}
+
+// ServiceUpdateStatus returns the configured statuses in order, repeating the last one.
+func (c *mockDockerClient) ServiceUpdateStatus(ctx *Context, name string) (ServiceUpdateStatus, error) {
+	if len(c.ServiceUpdates) == 0 {
+		return ServiceUpdateStatus{}, c.ServiceUpdateErr
+	}
+
+	status := c.ServiceUpdates[0]
+	if len(c.ServiceUpdates) > 1 {
+		c.ServiceUpdates = c.ServiceUpdates[1:]
+	}
+	return status, c.ServiceUpdateErr
+}
+
 func (c *mockDockerClient) Reset() {
 	c.PullArg = ""
 	c.PullErr = nil
 
+	c.GetDigestArg = ""
+	c.GetDigestOutput = ""
+	c.GetDigestErr = nil
+
 	c.GetImageIDArg = ""
 	c.GetImageIDOutput = ""
 	c.GetImageIDErr = nil
@@ -222,6 +583,80 @@ func (c *mockDockerClient) Reset() {
 
 	c.RemoveImageArg = ""
 	c.RemoveImageErr = nil
+
+	c.ListImagesArg = ""
+	c.ListImagesOutput = nil
+	c.ListImagesErr = nil
+
+	c.ImagesInUseOutput = nil
+	c.ImagesInUseErr = nil
+
+	c.RunContainerName = ""
+	c.RunContainerImage = ""
+	c.RunContainerSpec = ContainerSpec{}
+	c.RunContainerOutput = ""
+	c.RunContainerErr = nil
+
+	c.RunOnceName = ""
+	c.RunOnceImage = ""
+	c.RunOnceSpec = ContainerSpec{}
+	c.RunOnceOutput = ""
+	c.RunOnceExitCode = 0
+	c.RunOnceErr = nil
+
+	c.ExecName = ""
+	c.ExecCmd = nil
+	c.ExecOutput = ""
+	c.ExecErr = nil
+
+	c.HealthStatuses = nil
+	c.HealthStatusErr = nil
+
+	c.ContainerLogsName = ""
+	c.ContainerLogsLines = 0
+	c.ContainerLogsOutput = ""
+	c.ContainerLogsErr = nil
+
+	c.InspectContainerArg = ""
+	c.InspectContainerOutput = nil
+	c.InspectContainerErr = nil
+
+	c.InspectImageArg = ""
+	c.InspectImageOutput = nil
+	c.InspectImageErr = nil
+
+	c.CreateContainerName = ""
+	c.CreateContainerConfig = nil
+	c.CreateContainerErr = nil
+
+	c.ComposeImageArg = Compose{}
+	c.ComposeImageOutput = ""
+	c.ComposeImageErr = nil
+
+	c.ComposeUpArg = Compose{}
+	c.ComposeUpImage = ""
+	c.ComposeUpOutput = ""
+	c.ComposeUpErr = nil
+
+	c.ServiceImageArg = ""
+	c.ServiceImageOutput = ""
+	c.ServiceImageErr = nil
+
+	c.UpdateServiceArg = Swarm{}
+	c.UpdateServiceImage = ""
+	c.UpdateServiceOutput = ""
+	c.UpdateServiceErr = nil
+
+	c.ServiceUpdates = nil
+	c.ServiceUpdateErr = nil
+}
+
+func newTestContext() *Context {
+	return &Context{
+		id:      "test-request",
+		start:   time.Now(),
+		Context: context.Background(),
+	}
 }
 
 func performTestRequest(r http.Handler, req *http.Request) *httptest.ResponseRecorder {
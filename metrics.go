@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// counter monotonically increasing metric.
+type counter struct {
+	name  string
+	help  string
+	value int64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	counters = append(counters, c)
+	return c
+}
+
+func (c *counter) inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+func (c *counter) get() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// counters all registered counters, in the order they are exposed.
+var counters []*counter
+
+var (
+	authFailureCount = newCounter("redeployer_auth_failures_total", "Requests with an invalid deploy token.")
+	authLockouts     = newCounter("redeployer_auth_lockouts_total", "Clients locked out after repeated authentication failures.")
+	authLockedOut    = newCounter("redeployer_auth_locked_requests_total", "Requests rejected because the client was locked out.")
+	authSaturated    = newCounter("redeployer_auth_saturated_total", "Requests rejected because too many keys were being derived.")
+	rateLimited      = newCounter("redeployer_rate_limited_requests_total", "Requests rejected by rate limits.")
+	redeployTotal    = newCounter("redeployer_redeployments_total", "Redeployments started.")
+	redeployFailure  = newCounter("redeployer_redeployment_failures_total", "Redeployments which did not succeed.")
+)
+
+// serveMetrics exposes the counters in the prometheus text format.
+func serveMetrics(ctx *Context) (int, error) {
+	ctx.w.Header().Set(requestIDHeader, ctx.id)
+	ctx.w.Header().Set(contentTypeHeader, "text/plain; version=0.0.4")
+	ctx.w.WriteHeader(http.StatusOK)
+	for _, c := range counters {
+		fmt.Fprintf(ctx.w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.get())
+	}
+	return http.StatusOK, nil
+}
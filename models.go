@@ -1,14 +1,29 @@
 package main
 
 import (
+	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 // Config service configuration
 type Config struct {
-	Authentication AuthKey           `yaml:"authentication,omitempty"`
-	Services       map[string]Target `yaml:"services,omitempty"`
+	Authentication AuthKey                 `yaml:"authentication,omitempty"`
+	Credentials    map[string]AuthKey      `yaml:"credentials,omitempty"`
+	Services       map[string]Target       `yaml:"services,omitempty"`
+	Registries     map[string]RegistryAuth `yaml:"registries,omitempty"`
+	DockerConfig   string                  `yaml:"dockerConfig,omitempty"`
+	DiskSpace      *DiskSpaceGuard         `yaml:"diskSpace,omitempty"`
+	Freeze         []FreezeWindow          `yaml:"freeze,omitempty"`
+	RateLimits     *RateLimits             `yaml:"rateLimits,omitempty"`
+	AuthProtection *AuthProtection         `yaml:"authProtection,omitempty"`
+	AllowedIPs     []string                `yaml:"allowedIps,omitempty"`
+	TrustedProxies []string                `yaml:"trustedProxies,omitempty"`
+	TLS            *TLS                    `yaml:"tls,omitempty"`
+
+	RouteAllowedIPs          map[string][]string `yaml:"routeAllowedIps,omitempty"`
+	FreezeOverrideIdentities []string            `yaml:"freezeOverrideIdentities,omitempty"`
 }
 
 // AuthKey authentication key
@@ -17,22 +32,69 @@ type AuthKey struct {
 	Salt string `yaml:"salt,omitempty"`
 }
 
-// Target defines a script to be run by a webhook trigger.
+// Target defines a script to be run by a webhook trigger, or how to deploy
+// the service otherwise.
 type Target struct {
 	ID        string `yaml:"id,omitempty"`
+	Type      string `yaml:"type,omitempty"`
 	Binary    string `yaml:"binary,omitempty"`
 	Script    string `yaml:"script,omitempty"`
 	MustMatch string `yaml:"mustMatch,omitempty"`
+	Mode      string `yaml:"mode,omitempty"`
+
+	RequireDigest bool             `yaml:"requireDigest,omitempty"`
+	Freeze        []FreezeWindow   `yaml:"freeze,omitempty"`
+	VersionPolicy *VersionPolicy   `yaml:"versionPolicy,omitempty"`
+	Pull          *PullPolicy      `yaml:"pull,omitempty"`
+	Retention     *RetentionPolicy `yaml:"retention,omitempty"`
+	Signature     *SignaturePolicy `yaml:"signature,omitempty"`
+	BlueGreen     *BlueGreen       `yaml:"blueGreen,omitempty"`
+	Compose       *Compose         `yaml:"compose,omitempty"`
+	Systemd       *Systemd         `yaml:"systemd,omitempty"`
+	Kubernetes    *Kubernetes      `yaml:"kubernetes,omitempty"`
+	Swarm         *Swarm           `yaml:"swarm,omitempty"`
+	Container     *ContainerSpec   `yaml:"container,omitempty"`
+	RunBefore     []OneOff         `yaml:"runBefore,omitempty"`
+	Probes        []Probe          `yaml:"probes,omitempty"`
+	PreDeploy     []Hook           `yaml:"preDeploy,omitempty"`
+	PostDeploy    []Hook           `yaml:"postDeploy,omitempty"`
+
+	FailureLogLines  int           `yaml:"failureLogLines,omitempty"`
+	RequiresApproval bool          `yaml:"requiresApproval,omitempty"`
+	ApprovalTimeout  time.Duration `yaml:"approvalTimeout,omitempty"`
+	MinInterval      time.Duration `yaml:"minInterval,omitempty"`
+	AllowedIPs       []string      `yaml:"allowedIps,omitempty"`
+
+	AllowedIdentities []string `yaml:"allowedIdentities,omitempty"`
+}
+
+// recreates reports whether the target is deployed by recreating its running
+// container with a new image, which is the case when it has neither a script
+// nor a container spec.
+func (t Target) recreates() bool {
+	return t.Script == "" && t.Container == nil
 }
 
 func (t Target) execute(ctx *Context, args ...string) (string, error) {
-	allArgs := make([]string, len(args)+1)
-	allArgs[0] = t.Script
-	for i, arg := range args {
-		allArgs[i+1] = arg
+	return t.executeWithEnv(ctx, nil, args...)
+}
+
+// executeWithEnv runs the target with the given environment variables added
+// to the environment of the redeployer process. The script is left out of the
+// arguments when it is empty.
+func (t Target) executeWithEnv(ctx *Context, env []string, args ...string) (string, error) {
+	allArgs := make([]string, 0, len(args)+1)
+	if t.Script != "" {
+		allArgs = append(allArgs, t.Script)
+	}
+	allArgs = append(allArgs, args...)
+
+	cmd := exec.CommandContext(ctx, t.Binary, allArgs...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
 
-	rawOutput, err := exec.CommandContext(ctx, t.Binary, allArgs...).CombinedOutput()
+	rawOutput, err := cmd.CombinedOutput()
 	output := string(rawOutput)
 	if strings.HasSuffix(output, "\n") {
 		output = output[:len(output)-1]
@@ -43,8 +105,10 @@ func (t Target) execute(ctx *Context, args ...string) (string, error) {
 
 // RedeploymentRequest request body for redeployments.
 type RedeploymentRequest struct {
-	Target string `json:"target,omitempty"`
-	Image  string `json:"image,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Image    string `json:"image,omitempty"`
+	Override bool   `json:"override,omitempty"`
+	Reason   string `json:"reason,omitempty"`
 }
 
 // ResponseMessage response containing a string message.
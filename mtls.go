@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// clientCertPool reads the CA bundle that client certificates are verified against.
+func clientCertPool(path string) (*x509.CertPool, error) {
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// clientIdentities returns the identities of client certificates keyed by the
+// subject common name or subject alternative name that maps to them.
+func clientIdentities(cfg *TLS) map[string]string {
+	identities := make(map[string]string)
+	if cfg == nil {
+		return identities
+	}
+
+	for identity, names := range cfg.ClientIdentities {
+		for _, name := range names {
+			identities[name] = identity
+		}
+	}
+	return identities
+}
+
+// certificateNames returns the subject common name followed by the DNS, email
+// and URI subject alternative names of a certificate.
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// certificateIdentity returns the identity of a verified client certificate.
+func (h *handler) certificateIdentity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	for _, name := range certificateNames(r.TLS.VerifiedChains[0][0]) {
+		if identity, ok := h.clients[name]; ok && name != "" {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+// identityNames returns the names of all token credentials and client
+// certificate identities.
+func identityNames(cfg Config) map[string]bool {
+	names := make(map[string]bool)
+	for _, c := range parseCredentials(cfg) {
+		names[c.name] = true
+	}
+	for _, identity := range clientIdentities(cfg.TLS) {
+		names[identity] = true
+	}
+	return names
+}
+
+// allowsIdentity reports whether a token credential or client certificate
+// identity may deploy a target. Targets without allowed identities may be
+// deployed by all of them.
+func (t Target) allowsIdentity(identity string) bool {
+	if len(t.AllowedIdentities) == 0 {
+		return true
+	}
+
+	for _, allowed := range t.AllowedIdentities {
+		if allowed == identity {
+			return true
+		}
+	}
+	return false
+}
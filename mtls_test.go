@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLS_validateClientAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(TLS{
+		CertFile:         "cert.pem",
+		KeyFile:          "key.pem",
+		ClientCAFile:     "ca.pem",
+		ClientIdentities: map[string][]string{"ci": []string{"ci-runner", "spiffe://example.com/ci"}},
+	}.validate())
+
+	assert.Error(TLS{CertFile: "cert.pem", KeyFile: "key.pem", RequireClientCert: true}.validate())
+	assert.Error(TLS{
+		CertFile:         "cert.pem",
+		KeyFile:          "key.pem",
+		ClientIdentities: map[string][]string{"ci": []string{"ci-runner"}},
+	}.validate())
+	assert.Error(TLS{
+		CertFile:         "cert.pem",
+		KeyFile:          "key.pem",
+		ClientCAFile:     "ca.pem",
+		ClientIdentities: map[string][]string{"ci": []string{}},
+	}.validate())
+	assert.Error(TLS{
+		CertFile:     "cert.pem",
+		KeyFile:      "key.pem",
+		ClientCAFile: "ca.pem",
+		ClientIdentities: map[string][]string{
+			"ci":      []string{"ci-runner"},
+			"release": []string{"ci-runner"},
+		},
+	}.validate())
+}
+
+func TestTarget_allowsIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(Target{}.allowsIdentity("anyone"))
+	target := Target{AllowedIdentities: []string{"ci", "default"}}
+	assert.True(target.allowsIdentity("ci"))
+	assert.True(target.allowsIdentity("default"))
+	assert.False(target.allowsIdentity("release"))
+	assert.False(target.allowsIdentity(""))
+}
+
+func TestServer_clientCertificates(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+	dir, err := ioutil.TempDir("", "redeployer-mtls")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.Mkdir(filepath.Join(dir, "server"), 0700))
+	assert.NoError(os.Mkdir(filepath.Join(dir, "ca"), 0700))
+	certFile, keyFile := writeTestCertificate(t, filepath.Join(dir, "server"), "localhost")
+	caFile, caKeyFile := writeTestCertificate(t, filepath.Join(dir, "ca"), "client-ca")
+	ciCert := issueTestClientCertificate(t, caFile, caKeyFile, "ci-runner", "")
+	uriCert := issueTestClientCertificate(t, caFile, caKeyFile, "unmapped", "spiffe://example.com/release")
+	strangerCert := issueTestClientCertificate(t, caFile, caKeyFile, "stranger", "")
+
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			TLS: &TLS{
+				CertFile:     certFile,
+				KeyFile:      keyFile,
+				ClientCAFile: caFile,
+				ClientIdentities: map[string][]string{
+					"ci":      []string{"ci-runner"},
+					"release": []string{"spiffe://example.com/release"},
+				},
+			},
+			Services: map[string]Target{
+				"ci-svc": Target{
+					ID:                "ci-svc",
+					Binary:            "/bin/sh",
+					Script:            "./resources/test-svc.sh",
+					MustMatch:         "^repository/svc:.*",
+					AllowedIdentities: []string{"ci", "release"},
+				},
+				"token-svc": Target{
+					ID:                "token-svc",
+					Binary:            "/bin/sh",
+					Script:            "./resources/test-svc.sh",
+					MustMatch:         "^repository/svc:.*",
+					AllowedIdentities: []string{defaultCredential},
+				},
+			},
+		},
+		docker: &mockDockerClient{},
+	}
+	server := newServer(e, 9000)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	go server.Serve(tls.NewListener(listener, server.TLSConfig))
+	defer server.Close()
+
+	ca, err := ioutil.ReadFile(certFile)
+	assert.NoError(err)
+	roots := x509.NewCertPool()
+	assert.True(roots.AppendCertsFromPEM(ca))
+
+	redeploy := func(cert *tls.Certificate, target, token string) int {
+		tlsConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+		body, _ := json.Marshal(RedeploymentRequest{Target: target, Image: "repository/svc:1.1"})
+		req, _ := http.NewRequest(http.MethodPost, "https://"+listener.Addr().String()+"/redeploy", strings.NewReader(string(body)))
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(http.StatusOK, redeploy(&ciCert, "ci-svc", ""))
+	assert.Equal(http.StatusOK, redeploy(&uriCert, "ci-svc", ""))
+	assert.Equal(http.StatusForbidden, redeploy(&ciCert, "token-svc", ""))
+	assert.Equal(http.StatusUnauthorized, redeploy(&strangerCert, "ci-svc", ""))
+	assert.Equal(http.StatusUnauthorized, redeploy(nil, "ci-svc", ""))
+	assert.Equal(http.StatusForbidden, redeploy(nil, "ci-svc", deployToken))
+	assert.Equal(http.StatusOK, redeploy(nil, "token-svc", deployToken))
+	assert.Equal(http.StatusOK, redeploy(&strangerCert, "token-svc", deployToken))
+}
+
+// issueTestClientCertificate issues a client certificate signed by a test CA,
+// with an optional URI subject alternative name.
+func issueTestClientCertificate(t *testing.T, caFile, caKeyFile, commonName, uri string) tls.Certificate {
+	ca, err := tls.LoadX509KeyPair(caFile, caKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if uri != "" {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = []*url.URL{u}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestServer_clientCertificatesOnly(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+	dir, err := ioutil.TempDir("", "redeployer-mtls")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.Mkdir(filepath.Join(dir, "server"), 0700))
+	assert.NoError(os.Mkdir(filepath.Join(dir, "ca"), 0700))
+	certFile, keyFile := writeTestCertificate(t, filepath.Join(dir, "server"), "localhost")
+	caFile, caKeyFile := writeTestCertificate(t, filepath.Join(dir, "ca"), "client-ca")
+	ciCert := issueTestClientCertificate(t, caFile, caKeyFile, "ci-runner", "")
+
+	cfg := Config{
+		TLS: &TLS{
+			CertFile:         certFile,
+			KeyFile:          keyFile,
+			ClientCAFile:     caFile,
+			ClientIdentities: map[string][]string{"ci": []string{"ci-runner"}},
+		},
+		Services: map[string]Target{
+			"ci-svc": Target{
+				ID:        "ci-svc",
+				Binary:    "/bin/sh",
+				Script:    "./resources/test-svc.sh",
+				MustMatch: "^repository/svc:.*",
+			},
+		},
+	}
+	assert.Empty(parseCredentials(cfg))
+	assert.Equal(map[string]bool{"ci": true}, identityNames(cfg))
+
+	server := newServer(&env{cfg: cfg, docker: &mockDockerClient{}}, 9000)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	go server.Serve(tls.NewListener(listener, server.TLSConfig))
+	defer server.Close()
+
+	ca, err := ioutil.ReadFile(certFile)
+	assert.NoError(err)
+	roots := x509.NewCertPool()
+	assert.True(roots.AppendCertsFromPEM(ca))
+
+	redeploy := func(cert *tls.Certificate, token string) int {
+		tlsConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+		body, _ := json.Marshal(RedeploymentRequest{Target: "ci-svc", Image: "repository/svc:1.1"})
+		req, _ := http.NewRequest(http.MethodPost, "https://"+listener.Addr().String()+"/redeploy", strings.NewReader(string(body)))
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(http.StatusOK, redeploy(&ciCert, ""))
+	assert.Equal(http.StatusUnauthorized, redeploy(nil, deployToken))
+	assert.Equal(http.StatusUnauthorized, redeploy(nil, ""))
+}
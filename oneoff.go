@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const defaultOneOffTimeout = 10 * time.Minute
+
+var errOneOffFailed = fmt.Errorf("One-off container failed")
+
+// OneOff one-shot container, such as a schema migration, which is run from the
+// new image before the target is rolled out. The rollout only continues if the
+// container exits with status 0.
+type OneOff struct {
+	Name      string        `yaml:"name,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	Container ContainerSpec `yaml:",inline"`
+}
+
+func (o OneOff) validate() error {
+	if !releasePattern.MatchString(o.Name) {
+		return fmt.Errorf("one-off containers require a name of letters, digits, '.', '_' or '-'")
+	}
+	if len(o.Container.Command) == 0 {
+		return fmt.Errorf("one-off container %s requires a command", o.Name)
+	}
+	if o.Timeout < 0 {
+		return fmt.Errorf("one-off container timeout must not be negative")
+	}
+	return o.Container.validate()
+}
+
+// OneOffResult outcome of a one-off container, recorded in the job.
+type OneOffResult struct {
+	Name     string `json:"name"`
+	ExitCode int    `json:"exitCode"`
+	Logs     string `json:"logs,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// RunOnce runs a container in the foreground until it exits and returns its logs
+// and exit code. The container is removed afterwards, also when it timed out.
+func (c *cliDockerClient) RunOnce(ctx *Context, name, image string, spec ContainerSpec) (string, int, error) {
+	log.Debugw("Running one-off container", "name", name, "image", image, "requestId", ctx.id)
+	target := Target{
+		Binary: "docker",
+		Script: "run",
+	}
+
+	cleanupCtx := ctx.detached()
+	removeIfExists(ctx, c, name)
+	defer removeIfExists(cleanupCtx, c, name)
+
+	output, runErr := target.execute(ctx, spec.createArgs(name, image)...)
+
+	inspect := Target{
+		Binary: "docker",
+		Script: "inspect",
+	}
+	state, err := inspect.execute(cleanupCtx, "--type", "container", "--format", "{{.State.ExitCode}}", name)
+	if err != nil {
+		log.Errorw("Failed to run one-off container", "output", output, "error", runErr, "requestId", ctx.id)
+		if runErr != nil {
+			return output, -1, runErr
+		}
+		return output, -1, err
+	}
+
+	exitCode, err := strconv.Atoi(state)
+	if err != nil {
+		return output, -1, err
+	}
+
+	return output, exitCode, ctx.Err()
+}
+
+// runOneOffs runs the one-off containers of a target in order, stopping at the
+// first one which does not exit successfully.
+func (e *env) runOneOffs(ctx *Context, target Target, job *Job) error {
+	for _, oneOff := range target.RunBefore {
+		timeout := oneOff.Timeout
+		if timeout == 0 {
+			timeout = defaultOneOffTimeout
+		}
+
+		runCtx, cancel := ctx.withTimeout(timeout)
+		name := target.ID + "-" + oneOff.Name
+		logs, exitCode, err := e.docker.RunOnce(runCtx, name, job.Image, oneOff.Container)
+		cancel()
+
+		result := OneOffResult{
+			Name:     oneOff.Name,
+			ExitCode: exitCode,
+			Logs:     secrets.redact(logs),
+		}
+		if err != nil {
+			result.Error = secrets.redact(err.Error())
+		}
+		job.OneOffs = append(job.OneOffs, result)
+
+		if err != nil || exitCode != 0 {
+			log.Errorw("One-off container failed", "name", name, "exitCode", exitCode, "logs", logs, "error", err, "requestId", ctx.id)
+			return fmt.Errorf("%s: %s exited with %d", errOneOffFailed, oneOff.Name, exitCode)
+		}
+		log.Infow("One-off container succeeded", "name", name, "requestId", ctx.id)
+	}
+
+	return nil
+}
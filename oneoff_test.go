@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRedeployContainer_oneOff(t *testing.T) {
+	assert := assert.New(t)
+
+	target := Target{
+		ID:     "test-svc",
+		Binary: "/bin/sh",
+		Script: "./resources/test-svc.sh",
+		RunBefore: []OneOff{
+			{
+				Name: "migrate",
+				Container: ContainerSpec{
+					Networks: []string{"backend"},
+					Command:  []string{"migrate", "up"},
+				},
+			},
+		},
+	}
+
+	dc := &mockDockerClient{
+		GetImageIDOutput: "repository/svc:1.0",
+		RunOnceOutput:    "migration 42 failed",
+		RunOnceExitCode:  1,
+	}
+	e := &env{docker: dc}
+
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	e.redeployContainer(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal("test-svc-migrate", dc.RunOnceName)
+	assert.Equal("repository/svc:1.1", dc.RunOnceImage)
+	assert.Equal([]string{"migrate", "up"}, dc.RunOnceSpec.Command)
+	assert.Equal([]OneOffResult{{Name: "migrate", ExitCode: 1, Logs: "migration 42 failed"}}, job.OneOffs)
+	assert.Equal("", dc.GetImageIDArg)
+	assert.Equal("", dc.RemoveContainerArg)
+
+	dc.Reset()
+	dc.GetImageIDOutput = "repository/svc:1.0"
+	job = newJob(newTestContext(), target, "repository/svc:1.1")
+	e.redeployContainer(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Equal("test-svc-migrate", dc.RunOnceName)
+	assert.Equal("test-svc", dc.RemoveContainerArg)
+	assert.Len(job.OneOffs, 1)
+}
+
+func TestOneOff_config(t *testing.T) {
+	assert := assert.New(t)
+
+	raw := `
+name: migrate
+timeout: 2m
+command: ["migrate", "up"]
+env:
+  DATABASE_URL: postgres://db/app
+`
+	var oneOff OneOff
+	err := yaml.Unmarshal([]byte(raw), &oneOff)
+	assert.NoError(err)
+	assert.NoError(oneOff.validate())
+	assert.Equal([]string{"migrate", "up"}, oneOff.Container.Command)
+	assert.Equal("postgres://db/app", oneOff.Container.Env["DATABASE_URL"])
+
+	assert.Equal(
+		[]string{"--name", "svc-migrate", "-e", "DATABASE_URL=postgres://db/app", "repository/svc:1.1", "migrate", "up"},
+		oneOff.Container.createArgs("svc-migrate", "repository/svc:1.1"),
+	)
+
+	assert.Error(OneOff{Name: "migrate"}.validate())
+	assert.Error(OneOff{Name: "../migrate", Container: ContainerSpec{Command: []string{"up"}}}.validate())
+}
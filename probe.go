@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Probe types.
+const (
+	probeHTTP   = "http"
+	probeTCP    = "tcp"
+	probeExec   = "exec"
+	probeDocker = "docker"
+
+	healthHealthy = "healthy"
+
+	defaultProbeInterval = 2 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+	defaultProbeRetries  = 30
+)
+
+var (
+	errProbeFailed   = fmt.Errorf("Post-deploy probe failed")
+	errNoHealthcheck = fmt.Errorf("Container has no healthcheck")
+)
+
+// Probe check run after a deployment to verify that the service came up. A
+// probe passes once it has succeeded successThreshold times in a row and fails
+// when it has failed more than retries times. Blue/green deployments are probed
+// before traffic is switched to them, with $REDEPLOYER_HOST_PORT in the url or
+// address referring to the port of the new color.
+type Probe struct {
+	Type             string        `yaml:"type,omitempty"`
+	URL              string        `yaml:"url,omitempty"`
+	ExpectStatus     int           `yaml:"expectStatus,omitempty"`
+	ExpectBody       string        `yaml:"expectBody,omitempty"`
+	Address          string        `yaml:"address,omitempty"`
+	Command          []string      `yaml:"command,omitempty"`
+	Interval         time.Duration `yaml:"interval,omitempty"`
+	Timeout          time.Duration `yaml:"timeout,omitempty"`
+	Retries          int           `yaml:"retries,omitempty"`
+	SuccessThreshold int           `yaml:"successThreshold,omitempty"`
+}
+
+func (p Probe) validate(target Target) error {
+	switch p.Type {
+	case probeHTTP:
+		if p.URL == "" {
+			return fmt.Errorf("http probes require a url")
+		}
+	case probeTCP:
+		if p.Address == "" {
+			return fmt.Errorf("tcp probes require an address")
+		}
+	case probeExec, probeDocker:
+		if target.Type != "" && target.Type != typeDocker {
+			return fmt.Errorf("%s probes are only supported for docker targets", p.Type)
+		}
+		if p.Type == probeExec && len(p.Command) == 0 {
+			return fmt.Errorf("exec probes require a command")
+		}
+	default:
+		return fmt.Errorf("unknown probe type: %s", p.Type)
+	}
+
+	if p.Interval < 0 || p.Timeout < 0 || p.Retries < 0 || p.SuccessThreshold < 0 {
+		return fmt.Errorf("probe interval, timeout, retries and successThreshold must not be negative")
+	}
+	return nil
+}
+
+func (p Probe) withDefaults() Probe {
+	if p.Interval == 0 {
+		p.Interval = defaultProbeInterval
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaultProbeTimeout
+	}
+	if p.Retries == 0 {
+		p.Retries = defaultProbeRetries
+	}
+	if p.SuccessThreshold == 0 {
+		p.SuccessThreshold = 1
+	}
+	return p
+}
+
+func (p Probe) String() string {
+	switch p.Type {
+	case probeHTTP:
+		return p.Type + " " + p.URL
+	case probeTCP:
+		return p.Type + " " + p.Address
+	case probeExec:
+		return p.Type + " " + strings.Join(p.Command, " ")
+	default:
+		return p.Type
+	}
+}
+
+// ProbeResult outcome of a probe, recorded in the job.
+type ProbeResult struct {
+	Probe    string `json:"probe"`
+	Passed   bool   `json:"passed"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Exec runs a command inside a running container.
+func (c *cliDockerClient) Exec(ctx *Context, name string, command []string) (string, error) {
+	log.Debugw("Executing in container", "name", name, "command", command, "requestId", ctx.id)
+	target := Target{
+		Binary: "docker",
+		Script: "exec",
+	}
+
+	return target.execute(ctx, append([]string{name}, command...)...)
+}
+
+// HealthStatus returns the status of the docker healthcheck of a container, or
+// an empty string if it has none.
+func (c *cliDockerClient) HealthStatus(ctx *Context, name string) (string, error) {
+	target := Target{
+		Binary: "docker",
+		Script: "inspect",
+	}
+
+	output, err := target.execute(ctx, "--type", "container", "--format", "{{if .State.Health}}{{.State.Health.Status}}{{end}}", name)
+	if err != nil {
+		log.Errorw("Failed to get container health", "name", name, "output", output, "error", err, "requestId", ctx.id)
+	}
+
+	return output, err
+}
+
+// runProbes runs the probes of a target in order and records their results in
+// the job. It returns an error at the first probe which does not pass.
+func (e *env) runProbes(ctx *Context, target Target, job *Job) error {
+	return e.runProbesOn(ctx, target, job, e.containerName(target), nil)
+}
+
+// runProbesOn runs the probes of a target against a container. Variables such as
+// $REDEPLOYER_HOST_PORT are expanded in the url and address of probes, so that a
+// blue/green deployment can be probed before traffic is switched to it.
+func (e *env) runProbesOn(ctx *Context, target Target, job *Job, container string, vars map[string]string) error {
+	for _, probe := range target.Probes {
+		probe.URL = expandProbeVars(probe.URL, vars)
+		probe.Address = expandProbeVars(probe.Address, vars)
+		result := e.runProbe(ctx, container, probe.withDefaults())
+		job.Probes = append(job.Probes, result)
+		if !result.Passed {
+			log.Errorw("Post-deploy probe failed", "probe", result.Probe, "attempts", result.Attempts, "error", result.Error, "requestId", ctx.id)
+			return fmt.Errorf("%s: %s", errProbeFailed, result.Probe)
+		}
+		log.Infow("Post-deploy probe passed", "probe", result.Probe, "attempts", result.Attempts, "requestId", ctx.id)
+	}
+
+	return nil
+}
+
+// expandProbeVars replaces the given variables in a string, leaving any other
+// references as they are.
+func expandProbeVars(str string, vars map[string]string) string {
+	if len(vars) == 0 {
+		return str
+	}
+	return os.Expand(str, func(name string) string {
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return "${" + name + "}"
+	})
+}
+
+func (e *env) runProbe(ctx *Context, container string, probe Probe) ProbeResult {
+	result := ProbeResult{Probe: probe.String()}
+	successes, failures := 0, 0
+	for {
+		result.Attempts++
+		probeCtx, cancel := ctx.withTimeout(probe.Timeout)
+		err := e.check(probeCtx, container, probe)
+		cancel()
+
+		if err == nil {
+			successes++
+			if successes >= probe.SuccessThreshold {
+				result.Passed = true
+				result.Error = ""
+				return result
+			}
+		} else {
+			successes = 0
+			failures++
+			result.Error = secrets.redact(err.Error())
+			if failures > probe.Retries || err == errNoHealthcheck {
+				return result
+			}
+			log.Debugw("Waiting for probe to pass", "probe", result.Probe, "error", err, "requestId", ctx.id)
+		}
+
+		select {
+		case <-ctx.Done():
+			result.Error = ctx.Err().Error()
+			return result
+		case <-time.After(probe.Interval):
+		}
+	}
+}
+
+// check runs a single attempt of a probe against a container.
+func (e *env) check(ctx *Context, container string, probe Probe) error {
+	switch probe.Type {
+	case probeHTTP:
+		return checkHTTP(ctx, probe)
+	case probeTCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", probe.Address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case probeExec:
+		output, err := e.docker.Exec(ctx, container, probe.Command)
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, output)
+		}
+		return nil
+	case probeDocker:
+		status, err := e.docker.HealthStatus(ctx, container)
+		if err != nil {
+			return err
+		}
+		if status == "" {
+			return errNoHealthcheck
+		}
+		if status != healthHealthy {
+			return fmt.Errorf("container is %s", status)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown probe type: %s", probe.Type)
+	}
+}
+
+func checkHTTP(ctx *Context, probe Probe) error {
+	req, err := http.NewRequest(http.MethodGet, probe.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if probe.ExpectStatus != 0 && res.StatusCode != probe.ExpectStatus {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	if probe.ExpectStatus == 0 && (res.StatusCode < 200 || res.StatusCode >= 300) {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	if probe.ExpectBody != "" {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), probe.ExpectBody) {
+			return fmt.Errorf("response body does not contain %q", probe.ExpectBody)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunProbes_http(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"status":"ok"}`)
+	}))
+	defer server.Close()
+
+	target := Target{
+		ID: "test-svc",
+		Probes: []Probe{
+			{
+				Type:             probeHTTP,
+				URL:              server.URL + "/health",
+				ExpectBody:       `"ok"`,
+				Interval:         time.Millisecond,
+				Retries:          2,
+				SuccessThreshold: 2,
+			},
+		},
+	}
+
+	e := &env{docker: &mockDockerClient{}}
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	err := e.runProbes(newTestContext(), target, job)
+	assert.NoError(err)
+	assert.Equal([]ProbeResult{{Probe: "http " + server.URL + "/health", Passed: true, Attempts: 4}}, job.Probes)
+
+	target.Probes[0].ExpectBody = "healthy"
+	job = newJob(newTestContext(), target, "repository/svc:1.1")
+	err = e.runProbes(newTestContext(), target, job)
+	assert.Error(err)
+	assert.False(job.Probes[0].Passed)
+	assert.Equal(3, job.Probes[0].Attempts)
+	assert.Contains(job.Probes[0].Error, "does not contain")
+}
+
+func TestRunProbes_tcp(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	address := listener.Addr().String()
+
+	target := Target{
+		ID:     "test-svc",
+		Probes: []Probe{{Type: probeTCP, Address: address, Interval: time.Millisecond, Retries: 1}},
+	}
+
+	e := &env{docker: &mockDockerClient{}}
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	assert.NoError(e.runProbes(newTestContext(), target, job))
+
+	listener.Close()
+	job = newJob(newTestContext(), target, "repository/svc:1.1")
+	assert.Error(e.runProbes(newTestContext(), target, job))
+	assert.Equal(2, job.Probes[0].Attempts)
+}
+
+func TestRunProbes_container(t *testing.T) {
+	assert := assert.New(t)
+
+	target := Target{
+		ID: "test-svc",
+		Probes: []Probe{
+			{Type: probeDocker, Interval: time.Millisecond},
+			{Type: probeExec, Command: []string{"pg_isready"}, Interval: time.Millisecond},
+		},
+	}
+
+	dc := &mockDockerClient{HealthStatuses: []string{"starting", "starting", healthHealthy}}
+	e := &env{docker: dc}
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	assert.NoError(e.runProbes(newTestContext(), target, job))
+	assert.Equal(3, job.Probes[0].Attempts)
+	assert.Equal("test-svc", dc.ExecName)
+	assert.Equal([]string{"pg_isready"}, dc.ExecCmd)
+
+	dc.Reset()
+	job = newJob(newTestContext(), target, "repository/svc:1.1")
+	assert.Error(e.runProbes(newTestContext(), target, job))
+	assert.Equal(errNoHealthcheck.Error(), job.Probes[0].Error)
+	assert.Equal(1, job.Probes[0].Attempts)
+
+	assert.Error(Probe{Type: probeDocker}.validate(Target{Type: typeKubernetes}))
+	assert.Error(Probe{Type: "grpc"}.validate(Target{}))
+	assert.Error(Probe{Type: probeHTTP}.validate(Target{}))
+	assert.NoError(Probe{Type: probeHTTP, URL: "http://localhost:8080/health"}.validate(Target{Type: typeKubernetes}))
+}
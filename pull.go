@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultPullAttempts   = 3
+	defaultPullBackoff    = 2 * time.Second
+	defaultPullMaxBackoff = 30 * time.Second
+	defaultPullTimeout    = 10 * time.Minute
+)
+
+// PullPolicy configures how images are pulled. Failed pulls are retried with
+// exponential backoff and jitter, and each attempt is limited by the timeout.
+type PullPolicy struct {
+	Attempts   int           `yaml:"attempts,omitempty"`
+	Backoff    time.Duration `yaml:"backoff,omitempty"`
+	MaxBackoff time.Duration `yaml:"maxBackoff,omitempty"`
+	Timeout    time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (p PullPolicy) validate() error {
+	if p.Attempts < 0 || p.Backoff < 0 || p.MaxBackoff < 0 || p.Timeout < 0 {
+		return fmt.Errorf("pull attempts, backoff and timeouts must not be negative")
+	}
+	return nil
+}
+
+func (p *PullPolicy) withDefaults() PullPolicy {
+	var policy PullPolicy
+	if p != nil {
+		policy = *p
+	}
+
+	if policy.Attempts == 0 {
+		policy.Attempts = defaultPullAttempts
+	}
+	if policy.Backoff == 0 {
+		policy.Backoff = defaultPullBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = defaultPullMaxBackoff
+	}
+	if policy.Timeout == 0 {
+		policy.Timeout = defaultPullTimeout
+	}
+
+	return policy
+}
+
+// backoff returns the time to wait before the given retry, where the first
+// retry is 1. Half of the delay is randomized so that redeployers pulling from
+// the same registry spread out their retries.
+func (p PullPolicy) backoff(retry int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < retry && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// pull pulls an image, retrying failed attempts according to the pull policy
+// of the target.
+func (e *env) pull(ctx *Context, target Target, image string) error {
+	policy := target.Pull.withDefaults()
+
+	var err error
+	for attempt := 1; attempt <= policy.Attempts; attempt++ {
+		pullCtx, cancel := ctx.withTimeout(policy.Timeout)
+		err = e.docker.Pull(pullCtx, image)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if attempt == policy.Attempts {
+			break
+		}
+
+		delay := policy.backoff(attempt)
+		log.Warnw("Failed to pull image, retrying", "image", image, "attempt", attempt, "retryIn", delay.String(), "error", err, "requestId", ctx.id)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	log.Errorw("Giving up pulling image", "image", image, "attempts", policy.Attempts, "error", err, "requestId", ctx.id)
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPull_retries(t *testing.T) {
+	assert := assert.New(t)
+
+	target := Target{
+		ID:     "test-svc",
+		Binary: "/bin/sh",
+		Script: "./resources/test-svc.sh",
+		Pull: &PullPolicy{
+			Attempts: 3,
+			Backoff:  time.Millisecond,
+			Timeout:  time.Second,
+		},
+	}
+
+	dc := &flakyPullDockerClient{failures: 2}
+	e := &env{docker: dc}
+	err := e.pull(newTestContext(), target, "repository/svc:1.1")
+	assert.NoError(err)
+	assert.Equal(3, dc.attempts)
+	assert.True(dc.hadDeadline)
+
+	dc = &flakyPullDockerClient{failures: 3}
+	e = &env{docker: dc}
+	err = e.pull(newTestContext(), target, "repository/svc:1.1")
+	assert.Error(err)
+	assert.Equal(3, dc.attempts)
+}
+
+func TestRedeployContainer_pullFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	target := Target{
+		ID:     "test-svc",
+		Binary: "/bin/sh",
+		Script: "./resources/test-svc.sh",
+		Pull:   &PullPolicy{Attempts: 2, Backoff: time.Millisecond},
+	}
+
+	dc := &flakyPullDockerClient{
+		mockDockerClient: mockDockerClient{GetImageIDOutput: "repository/svc:1.0"},
+		failures:         2,
+	}
+	e := &env{docker: dc}
+
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	e.redeployContainer(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal(2, dc.attempts)
+	assert.Equal("", dc.GetImageIDArg)
+	assert.Equal("", dc.RemoveContainerArg)
+	assert.Equal("", dc.RemoveImageArg)
+}
+
+func TestPullPolicy_backoff(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := (&PullPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}).withDefaults()
+	assert.Equal(defaultPullAttempts, policy.Attempts)
+	assert.Equal(defaultPullTimeout, policy.Timeout)
+
+	for i := 0; i < 20; i++ {
+		first := policy.backoff(1)
+		assert.True(first >= 500*time.Millisecond && first <= time.Second)
+
+		third := policy.backoff(3)
+		assert.True(third >= 2*time.Second && third <= 4*time.Second)
+
+		capped := policy.backoff(10)
+		assert.True(capped >= 2500*time.Millisecond && capped <= 5*time.Second)
+	}
+
+	assert.Error(PullPolicy{Attempts: -1}.validate())
+	assert.NoError(PullPolicy{}.validate())
+}
+
+// flakyPullDockerClient fails the first pulls of an image.
+type flakyPullDockerClient struct {
+	mockDockerClient
+	failures    int
+	attempts    int
+	hadDeadline bool
+}
+
+func (c *flakyPullDockerClient) Pull(ctx *Context, image string) error {
+	c.attempts++
+	_, c.hadDeadline = ctx.Deadline()
+	if c.attempts <= c.failures {
+		return fmt.Errorf("net/http: TLS handshake timeout")
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	retryAfterHeader = "Retry-After"
+
+	// maxIdleBuckets number of buckets kept before full ones are dropped.
+	maxIdleBuckets = 1024
+)
+
+var errTooManyRequests = fmt.Errorf("Too many requests") // 429
+
+// RateLimits configures token bucket rate limits on requests, per source IP and
+// per authenticated credential.
+type RateLimits struct {
+	PerIP         *Rate `yaml:"perIp,omitempty"`
+	PerCredential *Rate `yaml:"perCredential,omitempty"`
+}
+
+// Rate sustained number of requests per minute, with bursts of up to burst requests.
+type Rate struct {
+	PerMinute float64 `yaml:"perMinute,omitempty"`
+	Burst     int     `yaml:"burst,omitempty"`
+}
+
+func (r Rate) validate() error {
+	if r.PerMinute <= 0 || r.Burst < 0 {
+		return fmt.Errorf("rate limits require a positive perMinute and a non negative burst")
+	}
+	return nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter token buckets by key, such as an IP address or credential name.
+type rateLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	capacity float64
+	buckets  map[string]*bucket
+}
+
+func newRateLimiter(rate *Rate) *rateLimiter {
+	if rate == nil {
+		return nil
+	}
+
+	capacity := float64(rate.Burst)
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &rateLimiter{
+		rate:     rate.PerMinute / 60,
+		capacity: capacity,
+		buckets:  make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the bucket of a key. If there is none it returns how
+// long until there is. A nil limiter allows everything.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.capacity, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.capacity, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / l.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// prune drops buckets which have refilled, as they are the same as new ones.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimits limiters applied by the router.
+type rateLimits struct {
+	perIP         *rateLimiter
+	perCredential *rateLimiter
+}
+
+func newRateLimits(cfg *RateLimits) *rateLimits {
+	if cfg == nil {
+		return &rateLimits{}
+	}
+
+	return &rateLimits{
+		perIP:         newRateLimiter(cfg.PerIP),
+		perCredential: newRateLimiter(cfg.PerCredential),
+	}
+}
+
+// setRetryAfter tells the client of a rejected request when to try again.
+func (ctx *Context) setRetryAfter(retryAfter time.Duration) {
+	ctx.w.Header().Set(retryAfterHeader, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// sendTooManyRequests rejects a request which should be retried later.
+func (ctx *Context) sendTooManyRequests(retryAfter time.Duration) {
+	ctx.setRetryAfter(retryAfter)
+	ctx.sendError(errTooManyRequests, http.StatusTooManyRequests)
+}
+
+// checkMinInterval returns how long until a target may be deployed again, if
+// its minimum interval since the last successful deployment, or since the start
+// of a deployment still in progress, has not passed.
+func (e *env) checkMinInterval(target Target, now time.Time) time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.minIntervalWait(target, now)
+}
+
+// reserveMinInterval is checkMinInterval, but also records the start of a
+// deployment of the target if it may proceed, so that concurrent requests are
+// rejected until it has finished.
+func (e *env) reserveMinInterval(target Target, now time.Time) time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	wait := e.minIntervalWait(target, now)
+	if wait > 0 || target.MinInterval == 0 {
+		return wait
+	}
+
+	if e.started == nil {
+		e.started = make(map[string]time.Time)
+	}
+	e.started[target.ID] = now
+	return 0
+}
+
+// minIntervalWait must be called with e.mu held.
+func (e *env) minIntervalWait(target Target, now time.Time) time.Duration {
+	if target.MinInterval == 0 {
+		return 0
+	}
+
+	last, ok := e.lastSuccess[target.ID]
+	if started, running := e.started[target.ID]; running && started.After(last) {
+		last, ok = started, true
+	}
+	if !ok {
+		return 0
+	}
+
+	return last.Add(target.MinInterval).Sub(now)
+}
+
+func (e *env) recordSuccess(target Target, finished time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.lastSuccess == nil {
+		e.lastSuccess = make(map[string]time.Time)
+	}
+	e.lastSuccess[target.ID] = finished
+	delete(e.started, target.ID)
+}
+
+// recordFailure releases the reservation of a failed deployment so that the
+// target may be retried straight away.
+func (e *env) recordFailure(target Target) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.started, target.ID)
+}
+
+// rejectTooRecent tells the client when a target may be deployed again.
+func (e *env) rejectTooRecent(ctx *Context, target Target, wait time.Duration) (int, error) {
+	log.Warnw("Target deployed too recently", "service", target.ID, "minInterval", target.MinInterval, "requestId", ctx.id)
+	rateLimited.inc()
+	ctx.setRetryAfter(wait)
+	return http.StatusTooManyRequests, errTooManyRequests
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	limiter := newRateLimiter(&Rate{PerMinute: 6, Burst: 2})
+
+	ok, _ := limiter.allow("10.0.0.1", now)
+	assert.True(ok)
+	ok, _ = limiter.allow("10.0.0.1", now)
+	assert.True(ok)
+	ok, wait := limiter.allow("10.0.0.1", now)
+	assert.False(ok)
+	assert.Equal(10*time.Second, wait)
+
+	ok, _ = limiter.allow("10.0.0.2", now)
+	assert.True(ok)
+
+	ok, _ = limiter.allow("10.0.0.1", now.Add(5*time.Second))
+	assert.False(ok)
+	ok, _ = limiter.allow("10.0.0.1", now.Add(10*time.Second))
+	assert.True(ok)
+
+	limiter.prune(now.Add(time.Hour))
+	assert.Empty(limiter.buckets)
+
+	var disabled *rateLimiter
+	ok, _ = disabled.allow("10.0.0.1", now)
+	assert.True(ok)
+
+	assert.Error(Rate{}.validate())
+	assert.NoError(Rate{PerMinute: 1}.validate())
+}
+
+func TestRedeploy_rateLimits(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			RateLimits: &RateLimits{
+				PerIP: &Rate{PerMinute: 1, Burst: 2},
+			},
+			Services: map[string]Target{
+				"test-svc": Target{
+					ID:          "test-svc",
+					Binary:      "/bin/sh",
+					Script:      "./resources/test-svc.sh",
+					MustMatch:   "^repository/svc:.*",
+					MinInterval: time.Hour,
+				},
+			},
+		},
+		docker: &mockDockerClient{},
+	}
+	server := newServer(e, 9000)
+	e.recordSuccess(e.cfg.Services["test-svc"], time.Now().Add(-59*time.Minute))
+
+	req1 := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.1",
+	})
+	req1.Header.Set(tokenHeader, deployToken)
+	res1 := performTestRequest(server.Handler, req1)
+	assert.Equal(http.StatusTooManyRequests, res1.Code)
+	assertRetryAfter(t, res1.Header().Get(retryAfterHeader), 58, 60)
+
+	req2 := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.1",
+	})
+	req2.Header.Set(tokenHeader, deployToken)
+	res2 := performTestRequest(server.Handler, req2)
+	assert.Equal(http.StatusTooManyRequests, res2.Code)
+
+	req3 := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.1",
+	})
+	req3.Header.Set(tokenHeader, deployToken)
+	res3 := performTestRequest(server.Handler, req3)
+	assert.Equal(http.StatusTooManyRequests, res3.Code)
+	assertRetryAfter(t, res3.Header().Get(retryAfterHeader), 58, 60)
+}
+
+func TestReserveMinInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	target := Target{ID: "test-svc", MinInterval: time.Hour}
+	e := &env{}
+
+	assert.Equal(time.Duration(0), e.reserveMinInterval(target, now))
+	assert.Equal(time.Hour, e.checkMinInterval(target, now))
+	assert.Equal(59*time.Minute, e.reserveMinInterval(target, now.Add(time.Minute)))
+
+	e.recordFailure(target)
+	assert.Equal(time.Duration(0), e.reserveMinInterval(target, now.Add(time.Minute)))
+
+	e.recordSuccess(target, now.Add(2*time.Minute))
+	assert.Empty(e.started)
+	assert.Equal(time.Hour, e.reserveMinInterval(target, now.Add(2*time.Minute)))
+
+	unlimited := Target{ID: "other-svc"}
+	assert.Equal(time.Duration(0), e.reserveMinInterval(unlimited, now))
+	assert.Equal(time.Duration(0), e.reserveMinInterval(unlimited, now))
+}
+
+func assertRetryAfter(t *testing.T, header string, min, max int) {
+	seconds, err := strconv.Atoi(header)
+	assert.NoError(t, err)
+	assert.True(t, seconds >= min && seconds <= max, "Retry-After %s not within [%d, %d]", header, min, max)
+}
+
+func TestRedeploy_minIntervalInProgress(t *testing.T) {
+	assert := assert.New(t)
+	deployToken := "625181dbfb5c6100cdacd97f3ba32ab4"
+
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			Services: map[string]Target{
+				"test-svc": Target{
+					ID:          "test-svc",
+					Binary:      "/bin/sh",
+					Script:      "./resources/test-svc.sh",
+					MustMatch:   "^repository/svc:.*",
+					MinInterval: time.Hour,
+				},
+			},
+		},
+		docker: &mockDockerClient{},
+	}
+	server := newServer(e, 9000)
+
+	req1 := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.1",
+	})
+	req1.Header.Set(tokenHeader, deployToken)
+	res1 := performTestRequest(server.Handler, req1)
+	assert.Equal(http.StatusOK, res1.Code)
+
+	req2 := createTestRequest("/redeploy", http.MethodPost, RedeploymentRequest{
+		Target: "test-svc",
+		Image:  "repository/svc:1.2",
+	})
+	req2.Header.Set(tokenHeader, deployToken)
+	res2 := performTestRequest(server.Handler, req2)
+	assert.Equal(http.StatusTooManyRequests, res2.Code)
+	assertRetryAfter(t, res2.Header().Get(retryAfterHeader), 3599, 3600)
+
+	time.Sleep(200 * time.Millisecond)
+}
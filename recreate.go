@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+)
+
+var errNoCapturedConfig = fmt.Errorf("No captured container configuration")
+
+// endpointSettings are the parts of a containers network endpoint that should
+// carry over to a recreated container. Addresses and ids are assigned anew.
+var endpointSettings = []string{"IPAMConfig", "Links", "Aliases", "DriverOpts"}
+
+// InspectContainer returns the full docker inspect output of a container.
+func (c *cliDockerClient) InspectContainer(ctx *Context, name string) (json.RawMessage, error) {
+	return c.inspect(ctx, "container", name)
+}
+
+// InspectImage returns the full docker inspect output of an image.
+func (c *cliDockerClient) InspectImage(ctx *Context, image string) (json.RawMessage, error) {
+	return c.inspect(ctx, "image", image)
+}
+
+func (c *cliDockerClient) inspect(ctx *Context, kind, name string) (json.RawMessage, error) {
+	log.Debugw("Inspecting "+kind, "name", name, "requestId", ctx.id)
+	target := Target{
+		Binary: "docker",
+		Script: "inspect",
+	}
+
+	output, err := target.execute(ctx, "--type", kind, name)
+	if err != nil {
+		log.Errorw("Failed to inspect "+kind, "output", output, "error", err, "requestId", ctx.id)
+		return nil, err
+	}
+
+	var results []json.RawMessage
+	err = json.Unmarshal([]byte(output), &results)
+	if err != nil || len(results) != 1 {
+		return nil, fmt.Errorf("Unexpected inspect output for %s", name)
+	}
+
+	return results[0], nil
+}
+
+// CreateContainer creates a named container from an engine API create request
+// and starts it.
+func (c *cliDockerClient) CreateContainer(ctx *Context, name string, config json.RawMessage) (string, error) {
+	log.Debugw("Creating container", "name", name, "requestId", ctx.id)
+	var created struct {
+		ID string `json:"Id"`
+	}
+
+	err := c.api.post(ctx, "/containers/create", url.Values{"name": {name}}, config, &created)
+	if err != nil {
+		log.Errorw("Failed to create container", "name", name, "error", err, "requestId", ctx.id)
+		return "", err
+	}
+
+	err = c.api.post(ctx, "/containers/"+created.ID+"/start", nil, nil, nil)
+	if err != nil {
+		log.Errorw("Failed to start container", "name", name, "error", err, "requestId", ctx.id)
+	}
+
+	return created.ID, err
+}
+
+// CapturedContainer the configuration of a container and of the image it ran,
+// as returned by docker inspect. It includes the environment of the container,
+// so it is never serialized, and it is only kept in memory for the duration of
+// the deployment that captured it.
+type CapturedContainer struct {
+	Container json.RawMessage `json:"container"`
+	Image     json.RawMessage `json:"image,omitempty"`
+}
+
+func (e *env) captureContainer(ctx *Context, name string) (*CapturedContainer, error) {
+	container, err := e.docker.InspectContainer(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var c struct {
+		Image string `json:"Image"`
+	}
+	err = json.Unmarshal(container, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := e.docker.InspectImage(ctx, c.Image)
+	if err != nil {
+		log.Warnw("Failed to inspect previous image, image defaults will be kept", "error", err, "requestId", ctx.id)
+	}
+
+	return &CapturedContainer{
+		Container: container,
+		Image:     image,
+	}, nil
+}
+
+// recreateContainer creates the container of a job from the configuration captured
+// from the container it replaces, with only the image changed.
+func (e *env) recreateContainer(ctx *Context, job *Job, name, image string) (string, error) {
+	if job.Captured == nil {
+		return "", errNoCapturedConfig
+	}
+
+	config, err := job.Captured.createConfig(image)
+	if err != nil {
+		return "", err
+	}
+
+	return e.docker.CreateContainer(ctx, name, config)
+}
+
+// rollbackContainer recreates the previous container of a target from the
+// configuration captured earlier in the same deployment, after a failed attempt
+// to start the new one.
+func (e *env) rollbackContainer(ctx *Context, target Target, job *Job, previous string) {
+	e.removeIfExists(ctx, target.ID)
+	_, err := e.recreateContainer(ctx, job, target.ID, previous)
+	if err != nil {
+		log.Errorw("Failed to roll back container", "image", previous, "error", err, "requestId", ctx.id)
+		return
+	}
+
+	job.Status = jobRolledBack
+	log.Warnw("Rolled back to previous container", "image", previous, "requestId", ctx.id)
+}
+
+// createConfig converts the captured configuration into a container create request
+// for the given image. Settings the container inherited from its old image are
+// left out so that the defaults of the new image apply, the way watchtower does.
+func (c CapturedContainer) createConfig(image string) (json.RawMessage, error) {
+	var container struct {
+		ID              string                 `json:"Id"`
+		Config          map[string]interface{} `json:"Config"`
+		HostConfig      map[string]interface{} `json:"HostConfig"`
+		NetworkSettings struct {
+			Networks map[string]map[string]interface{} `json:"Networks"`
+		} `json:"NetworkSettings"`
+	}
+	err := json.Unmarshal(c.Container, &container)
+	if err != nil {
+		return nil, err
+	}
+
+	var old struct {
+		Config map[string]interface{} `json:"Config"`
+	}
+	if len(c.Image) > 0 {
+		err = json.Unmarshal(c.Image, &old)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config := container.Config
+	if config == nil {
+		config = make(map[string]interface{})
+	}
+	removeImageDefaults(config, old.Config)
+
+	shortID := container.ID
+	if len(shortID) > 12 {
+		shortID = shortID[:12]
+	}
+	if config["Hostname"] == shortID {
+		delete(config, "Hostname")
+	}
+	config["Image"] = image
+
+	endpoints := make(map[string]interface{})
+	for network, settings := range container.NetworkSettings.Networks {
+		endpoint := make(map[string]interface{})
+		for _, key := range endpointSettings {
+			if v, ok := settings[key]; ok && v != nil {
+				endpoint[key] = v
+			}
+		}
+		if aliases, ok := endpoint["Aliases"].([]interface{}); ok {
+			endpoint["Aliases"] = removeValue(aliases, shortID)
+		}
+		endpoints[network] = endpoint
+	}
+
+	config["HostConfig"] = container.HostConfig
+	config["NetworkingConfig"] = map[string]interface{}{
+		"EndpointsConfig": endpoints,
+	}
+
+	return json.Marshal(config)
+}
+
+func removeImageDefaults(config, image map[string]interface{}) {
+	if image == nil {
+		return
+	}
+
+	for _, key := range []string{"Cmd", "Entrypoint", "WorkingDir", "User", "Healthcheck", "StopSignal"} {
+		if reflect.DeepEqual(config[key], image[key]) {
+			delete(config, key)
+		}
+	}
+
+	if env, ok := config["Env"].([]interface{}); ok {
+		imageEnv, _ := image["Env"].([]interface{})
+		config["Env"] = removeValues(env, imageEnv)
+	}
+
+	for _, key := range []string{"Labels", "ExposedPorts", "Volumes"} {
+		values, ok := config[key].(map[string]interface{})
+		imageValues, _ := image[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for k, v := range imageValues {
+			if reflect.DeepEqual(values[k], v) {
+				delete(values, k)
+			}
+		}
+	}
+}
+
+func removeValues(values, remove []interface{}) []interface{} {
+	for _, r := range remove {
+		values = removeValue(values, r)
+	}
+	return values
+}
+
+func removeValue(values []interface{}, remove interface{}) []interface{} {
+	kept := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		if !reflect.DeepEqual(v, remove) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
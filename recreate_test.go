@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testContainerInspect = `{
+	"Id": "3f2a9c1d4e5b6a7f8e9d0c1b2a3f4e5d6c7b8a9f0e1d2c3b4a5f6e7d8c9b0a1f",
+	"Image": "sha256:aaaa",
+	"Config": {
+		"Hostname": "3f2a9c1d4e5b",
+		"Env": ["PATH=/usr/local/bin:/usr/bin", "LOG_LEVEL=debug"],
+		"Cmd": ["serve"],
+		"Entrypoint": ["/entrypoint.sh"],
+		"Image": "repository/svc:1.0",
+		"Labels": {"maintainer": "image", "team": "platform"},
+		"ExposedPorts": {"8080/tcp": {}}
+	},
+	"HostConfig": {
+		"RestartPolicy": {"Name": "unless-stopped", "MaximumRetryCount": 0},
+		"PortBindings": {"8080/tcp": [{"HostIp": "", "HostPort": "8080"}]},
+		"Binds": ["data:/var/lib/svc"]
+	},
+	"NetworkSettings": {
+		"Networks": {
+			"backend": {
+				"Aliases": ["svc", "3f2a9c1d4e5b"],
+				"NetworkID": "net-id",
+				"EndpointID": "endpoint-id",
+				"IPAddress": "172.18.0.5"
+			}
+		}
+	}
+}`
+
+const testImageInspect = `{
+	"Config": {
+		"Env": ["PATH=/usr/local/bin:/usr/bin"],
+		"Cmd": ["serve"],
+		"Entrypoint": ["/entrypoint.sh"],
+		"Labels": {"maintainer": "image"},
+		"ExposedPorts": {"8080/tcp": {}}
+	}
+}`
+
+func TestCreateConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	captured := CapturedContainer{
+		Container: json.RawMessage(testContainerInspect),
+		Image:     json.RawMessage(testImageInspect),
+	}
+
+	raw, err := captured.createConfig("repository/svc:1.1")
+	assert.NoError(err)
+
+	var config map[string]interface{}
+	assert.NoError(json.Unmarshal(raw, &config))
+
+	assert.Equal("repository/svc:1.1", config["Image"])
+	assert.Equal([]interface{}{"LOG_LEVEL=debug"}, config["Env"])
+	assert.Equal(map[string]interface{}{"team": "platform"}, config["Labels"])
+	assert.Equal(map[string]interface{}{}, config["ExposedPorts"])
+	assert.NotContains(config, "Hostname")
+	assert.NotContains(config, "Cmd")
+	assert.NotContains(config, "Entrypoint")
+
+	hostConfig := config["HostConfig"].(map[string]interface{})
+	assert.Equal([]interface{}{"data:/var/lib/svc"}, hostConfig["Binds"])
+
+	networking := config["NetworkingConfig"].(map[string]interface{})
+	endpoints := networking["EndpointsConfig"].(map[string]interface{})
+	assert.Equal(map[string]interface{}{"Aliases": []interface{}{"svc"}}, endpoints["backend"])
+
+	captured.Image = nil
+	raw, err = captured.createConfig("repository/svc:1.1")
+	assert.NoError(err)
+	config = nil
+	assert.NoError(json.Unmarshal(raw, &config))
+	assert.Equal([]interface{}{"serve"}, config["Cmd"])
+}
+
+func TestRedeploy_recreate(t *testing.T) {
+	assert := assert.New(t)
+
+	target := Target{ID: "test-svc"}
+	dc := &flakyCreateDockerClient{
+		mockDockerClient: mockDockerClient{
+			GetImageIDOutput:       "repository/svc:1.0",
+			InspectContainerOutput: json.RawMessage(testContainerInspect),
+			InspectImageOutput:     json.RawMessage(testImageInspect),
+		},
+	}
+	e := &env{docker: dc}
+
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	e.redeployContainer(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.NotNil(job.Captured)
+	assert.Equal("test-svc", dc.InspectContainerArg)
+	assert.Equal("sha256:aaaa", dc.InspectImageArg)
+	assert.Equal("test-svc", dc.RemoveContainerArg)
+	assert.Equal([]string{"repository/svc:1.1"}, dc.created)
+	assert.Equal("repository/svc:1.0", dc.RemoveImageArg)
+
+	dc.Reset()
+	dc.GetImageIDOutput = "repository/svc:1.1"
+	dc.InspectContainerOutput = json.RawMessage(testContainerInspect)
+	dc.created = nil
+	dc.failFirst = true
+	job = newJob(newTestContext(), target, "repository/svc:1.2")
+	e.redeployContainer(newTestContext(), target, job)
+	assert.Equal(jobRolledBack, job.Status)
+	assert.Equal([]string{"repository/svc:1.2", "repository/svc:1.1"}, dc.created)
+	assert.Equal("", dc.RemoveImageArg)
+
+	dc.Reset()
+	dc.GetImageIDErr = errNoSuchContainer
+	job = newJob(newTestContext(), target, "repository/svc:1.2")
+	e.redeployContainer(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal(errNoCapturedConfig.Error(), job.Error)
+}
+
+// flakyCreateDockerClient records the images of created containers and can fail
+// the first attempt to create one.
+type flakyCreateDockerClient struct {
+	mockDockerClient
+	created   []string
+	failFirst bool
+}
+
+func (c *flakyCreateDockerClient) CreateContainer(ctx *Context, name string, config json.RawMessage) (string, error) {
+	var body struct {
+		Image string `json:"Image"`
+	}
+	json.Unmarshal(config, &body)
+	c.created = append(c.created, body.Image)
+
+	if c.failFirst && len(c.created) == 1 {
+		return "", fmt.Errorf("port is already allocated")
+	}
+	return "", nil
+}
+
+func TestJob_capturedNotSerialized(t *testing.T) {
+	assert := assert.New(t)
+
+	job := newJob(newTestContext(), Target{ID: "test-svc"}, "repository/svc:1.1")
+	job.Captured = &CapturedContainer{Container: json.RawMessage(testContainerInspect)}
+
+	raw, err := json.Marshal(job)
+	assert.NoError(err)
+	assert.NotContains(string(raw), "LOG_LEVEL")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "[REDACTED]"
+
+// minSecretLength secrets shorter than this are not redacted, as replacing them
+// would mangle unrelated output.
+const minSecretLength = 4
+
+var secrets = &secretRedactor{}
+
+// secretRedactor replaces known secrets in strings.
+type secretRedactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+func (r *secretRedactor) add(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.secrets {
+		if s == secret {
+			return
+		}
+	}
+	r.secrets = append(r.secrets, secret)
+}
+
+func (r *secretRedactor) redact(str string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.secrets {
+		str = strings.Replace(str, s, redacted, -1)
+	}
+	return str
+}
+
+// redactingCore zap core that removes known secrets from log messages and fields.
+type redactingCore struct {
+	zapcore.Core
+}
+
+func newRedactingCore(core zapcore.Core) zapcore.Core {
+	return &redactingCore{Core: core}
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(redactFields(fields))}
+}
+
+func (c *redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = secrets.redact(ent.Message)
+	return c.Core.Write(ent, redactFields(fields))
+}
+
+// redactFields converts fields that may contain secrets into redacted strings.
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redactedFields := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch f.Type {
+		case zapcore.StringType:
+			f.String = secrets.redact(f.String)
+		case zapcore.ByteStringType:
+			f = stringField(f.Key, string(f.Interface.([]byte)))
+		case zapcore.ErrorType:
+			f = stringField(f.Key, f.Interface.(error).Error())
+		case zapcore.StringerType:
+			f = stringField(f.Key, f.Interface.(fmt.Stringer).String())
+		case zapcore.ReflectType:
+			raw, err := json.Marshal(f.Interface)
+			if err == nil {
+				f = zapcore.Field{Key: f.Key, Type: zapcore.ReflectType, Interface: json.RawMessage(secrets.redact(string(raw)))}
+			}
+		}
+		redactedFields[i] = f
+	}
+	return redactedFields
+}
+
+func stringField(key, value string) zapcore.Field {
+	return zapcore.Field{Key: key, Type: zapcore.StringType, String: secrets.redact(value)}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	errInvalidReference = fmt.Errorf("Invalid image reference")
+
+	digestPattern = regexp.MustCompile("^sha256:[a-f0-9]{64}$")
+)
+
+// imageRef parsed docker image reference on the form name[:tag][@digest].
+type imageRef struct {
+	name   string
+	tag    string
+	digest string
+}
+
+func parseImageRef(image string) (imageRef, error) {
+	var ref imageRef
+	if i := strings.Index(image, "@"); i != -1 {
+		ref.digest = image[i+1:]
+		image = image[:i]
+		if !digestPattern.MatchString(ref.digest) {
+			return imageRef{}, errInvalidReference
+		}
+	}
+
+	ref.name = image
+	lastSlash := strings.LastIndex(image, "/")
+	if i := strings.LastIndex(image, ":"); i > lastSlash {
+		ref.name = image[:i]
+		ref.tag = image[i+1:]
+		if ref.tag == "" {
+			return imageRef{}, errInvalidReference
+		}
+	}
+
+	if ref.name == "" || strings.HasSuffix(ref.name, "/") {
+		return imageRef{}, errInvalidReference
+	}
+
+	return ref, nil
+}
+
+// familiarName returns the repository name the way docker displays it, without the
+// default registry and "library/" prefix of official images.
+func (r imageRef) familiarName() string {
+	name := strings.TrimPrefix(r.name, "docker.io/")
+	name = strings.TrimPrefix(name, "index.docker.io/")
+	return strings.TrimPrefix(name, "library/")
+}
+
+func (r imageRef) String() string {
+	str := r.name
+	if r.tag != "" {
+		str += ":" + r.tag
+	}
+	if r.digest != "" {
+		str += "@" + r.digest
+	}
+	return str
+}
+
+// imageTag returns the tag of an image reference, or an empty string if it has none.
+func imageTag(image string) string {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return ""
+	}
+	return ref.tag
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImageRef(t *testing.T) {
+	assert := assert.New(t)
+	digest := "sha256:4b0a2a4b3c9e3fbd1c2bd0f1d7c7e8a84cfb02e8e9bdc5a2e6d7a4ad7fbbf0c4"
+
+	ref, err := parseImageRef("repository/svc:1.4")
+	assert.NoError(err)
+	assert.Equal(imageRef{name: "repository/svc", tag: "1.4"}, ref)
+	assert.Equal("repository/svc:1.4", ref.String())
+
+	ref, err = parseImageRef("registry:5000/repository/svc")
+	assert.NoError(err)
+	assert.Equal(imageRef{name: "registry:5000/repository/svc"}, ref)
+
+	ref, err = parseImageRef("repository/svc@" + digest)
+	assert.NoError(err)
+	assert.Equal(imageRef{name: "repository/svc", digest: digest}, ref)
+
+	ref, err = parseImageRef("registry:5000/svc:1.4@" + digest)
+	assert.NoError(err)
+	assert.Equal(imageRef{name: "registry:5000/svc", tag: "1.4", digest: digest}, ref)
+	assert.Equal("registry:5000/svc:1.4@"+digest, ref.String())
+
+	for _, invalid := range []string{"", "svc:", "svc@sha256:abc", "svc@md5:4b0a", "repository/"} {
+		_, err = parseImageRef(invalid)
+		assert.Equal(errInvalidReference, err, invalid)
+	}
+}
+
+func TestFamiliarName(t *testing.T) {
+	assert := assert.New(t)
+
+	ref, err := parseImageRef("docker.io/library/nginx:1.17")
+	assert.NoError(err)
+	assert.Equal("nginx", ref.familiarName())
+
+	ref, err = parseImageRef("registry:5000/library/nginx")
+	assert.NoError(err)
+	assert.Equal("registry:5000/library/nginx", ref.familiarName())
+}
+
+func TestImageTag(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("1.4", imageTag("repository/svc:1.4"))
+	assert.Equal("1.4", imageTag("registry:5000/repository/svc:1.4"))
+	assert.Equal("", imageTag("registry:5000/repository/svc"))
+	assert.Equal("", imageTag("svc"))
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+var (
+	errManifestNotFound = fmt.Errorf("Manifest not found")
+	errRegistryRequest  = fmt.Errorf("Registry request failed")
+)
+
+// registryClient minimal client for the docker registry HTTP API v2.
+type registryClient struct {
+	client      *http.Client
+	credentials *credentialStore
+}
+
+func newRegistryClient(credentials *credentialStore) *registryClient {
+	return &registryClient{
+		client:      &http.Client{Timeout: 30 * time.Second},
+		credentials: credentials,
+	}
+}
+
+// manifest image manifest as returned by the registry.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// splitRepository splits a repository name into the registry host and the
+// repository path on that registry.
+func splitRepository(name string) (string, string) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		host := parts[0]
+		if host == "docker.io" || host == "index.docker.io" {
+			host = dockerHubRegistry
+		}
+		return host, parts[1]
+	}
+
+	if len(parts) == 1 {
+		return dockerHubRegistry, "library/" + name
+	}
+	return dockerHubRegistry, name
+}
+
+func (c *registryClient) getManifest(ctx *Context, name, reference string) (manifest, error) {
+	host, repo := splitRepository(name)
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repo, reference)
+	res, err := c.get(ctx, u, host, repo, mediaTypeOCIManifest+", "+mediaTypeDockerManifest)
+	if err != nil {
+		return manifest{}, err
+	}
+	defer res.Body.Close()
+
+	var m manifest
+	err = json.NewDecoder(res.Body).Decode(&m)
+	if err != nil {
+		return manifest{}, err
+	}
+
+	return m, nil
+}
+
+// getDigest returns the digest of the manifest a reference points to.
+func (c *registryClient) getDigest(ctx *Context, name, reference string) (string, error) {
+	host, repo := splitRepository(name)
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repo, reference)
+	res, err := c.get(ctx, u, host, repo, mediaTypeOCIManifest+", "+mediaTypeDockerManifest)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	digest := res.Header.Get("Docker-Content-Digest")
+	if !digestPattern.MatchString(digest) {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+	return digest, nil
+}
+
+// pinDigest returns an image reference which includes the digest of the image,
+// resolving it from the registry if the image is referenced by tag.
+func (e *env) pinDigest(ctx *Context, image string) (string, error) {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return "", err
+	}
+
+	if ref.digest != "" {
+		return image, nil
+	}
+
+	if e.registry == nil {
+		return "", errRegistryRequest
+	}
+
+	tag := ref.tag
+	if tag == "" {
+		tag = "latest"
+	}
+	ref.digest, err = e.registry.getDigest(ctx, ref.name, tag)
+	if err != nil {
+		return "", err
+	}
+
+	return ref.String(), nil
+}
+
+func (c *registryClient) getBlob(ctx *Context, name, digest string) ([]byte, error) {
+	host, repo := splitRepository(name)
+	u := fmt.Sprintf("https://%s/v2/%s/blobs/%s", host, repo, digest)
+	res, err := c.get(ctx, u, host, repo, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+}
+
+// get performs a GET request against the registry, authenticating with basic auth
+// or a bearer token if the registry requires it.
+func (c *registryClient) get(ctx *Context, u, host, repo, accept string) (*http.Response, error) {
+	res, err := c.do(ctx, u, accept, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge := res.Header.Get("WWW-Authenticate")
+		drain(res)
+
+		auth, _ := c.credentials.lookup(ctx, host)
+		authorization := ""
+		if strings.HasPrefix(strings.ToLower(challenge), "basic") {
+			authorization = basicAuth(auth)
+		} else {
+			token, err := c.fetchToken(ctx, challenge, repo, auth)
+			if err != nil {
+				return nil, err
+			}
+			authorization = "Bearer " + token
+		}
+
+		res, err = c.do(ctx, u, accept, authorization)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res, nil
+	case http.StatusNotFound:
+		drain(res)
+		return nil, errManifestNotFound
+	default:
+		drain(res)
+		log.Errorw("Unexpected registry response", "url", u, "status", res.StatusCode, "requestId", ctx.id)
+		return nil, errRegistryRequest
+	}
+}
+
+func (c *registryClient) do(ctx *Context, u, accept, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(ctx, req, accept, authorization)
+}
+
+func (c *registryClient) send(ctx *Context, req *http.Request, accept, authorization string) (*http.Response, error) {
+	req = req.WithContext(ctx)
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	return c.client.Do(req)
+}
+
+// fetchToken gets a bearer token from the token server of a registry. Identity
+// tokens are exchanged using the OAuth2 refresh token flow, other credentials
+// are sent as basic auth.
+func (c *registryClient) fetchToken(ctx *Context, challenge, repo string, auth RegistryAuth) (string, error) {
+	params := parseChallenge(challenge)
+	realm, ok := params["realm"]
+	if !ok {
+		log.Errorw("Unsupported registry auth challenge", "challenge", challenge, "requestId", ctx.id)
+		return "", errRegistryRequest
+	}
+
+	query := url.Values{}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", repo))
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+
+	var req *http.Request
+	var err error
+	if auth.Token != "" {
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", auth.Token)
+		query.Set("client_id", "redeployer")
+		req, err = http.NewRequest(http.MethodPost, realm, strings.NewReader(query.Encode()))
+		if err == nil {
+			req.Header.Set(contentTypeHeader, "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(http.MethodGet, realm+"?"+query.Encode(), nil)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	res, err := c.send(ctx, req, "", basicAuth(auth))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		log.Errorw("Failed to fetch registry token", "status", res.StatusCode, "requestId", ctx.id)
+		return "", errRegistryRequest
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// parseChallenge parses the parameters of a bearer WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+func parseChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return params
+	}
+
+	for _, param := range strings.Split(challenge[len("bearer "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+
+	return params
+}
+
+func basicAuth(auth RegistryAuth) string {
+	if auth.Username == "" && auth.Password == "" {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+auth.Password))
+}
+
+func drain(res *http.Response) {
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
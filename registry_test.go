@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRegistry fake registry serving manifests and blobs behind bearer token auth.
+type testRegistry struct {
+	server    *httptest.Server
+	manifests map[string][]byte
+	blobs     map[string][]byte
+}
+
+func newTestRegistry() *testRegistry {
+	reg := &testRegistry{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[string][]byte),
+	}
+
+	reg.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			json.NewEncoder(w).Encode(map[string]string{"token": "test-token:" + r.URL.Query().Get("scope")})
+			return
+		}
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer test-token:repository:") {
+			challenge := fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, reg.server.URL)
+			w.Header().Set("WWW-Authenticate", challenge)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var body []byte
+		var ok bool
+		switch {
+		case strings.Contains(r.URL.Path, "/manifests/"):
+			body, ok = reg.manifests[r.URL.Path]
+			w.Header().Set(contentTypeHeader, mediaTypeOCIManifest)
+		case strings.Contains(r.URL.Path, "/blobs/"):
+			body, ok = reg.blobs[r.URL.Path]
+		}
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	}))
+
+	return reg
+}
+
+func (reg *testRegistry) host() string {
+	return strings.TrimPrefix(reg.server.URL, "https://")
+}
+
+func (reg *testRegistry) client() *registryClient {
+	return &registryClient{
+		client: reg.server.Client(),
+	}
+}
+
+func (reg *testRegistry) addManifest(repo, reference string, m manifest) {
+	raw, _ := json.Marshal(m)
+	reg.manifests[fmt.Sprintf("/v2/%s/manifests/%s", repo, reference)] = raw
+}
+
+func (reg *testRegistry) addBlob(repo, digest string, blob []byte) {
+	reg.blobs[fmt.Sprintf("/v2/%s/blobs/%s", repo, digest)] = blob
+}
+
+func TestSplitRepository(t *testing.T) {
+	assert := assert.New(t)
+
+	host, repo := splitRepository("nginx")
+	assert.Equal(dockerHubRegistry, host)
+	assert.Equal("library/nginx", repo)
+
+	host, repo = splitRepository("czarsimon/httplogger")
+	assert.Equal(dockerHubRegistry, host)
+	assert.Equal("czarsimon/httplogger", repo)
+
+	host, repo = splitRepository("docker.io/czarsimon/httplogger")
+	assert.Equal(dockerHubRegistry, host)
+	assert.Equal("czarsimon/httplogger", repo)
+
+	host, repo = splitRepository("registry.example.com:5000/team/svc")
+	assert.Equal("registry.example.com:5000", host)
+	assert.Equal("team/svc", repo)
+
+	host, repo = splitRepository("localhost/svc")
+	assert.Equal("localhost", host)
+	assert.Equal("svc", repo)
+}
+
+func TestRegistryClient_getManifest(t *testing.T) {
+	assert := assert.New(t)
+	reg := newTestRegistry()
+	defer reg.server.Close()
+
+	reg.addManifest("repository/svc", "1.0", manifest{
+		MediaType: mediaTypeOCIManifest,
+		Layers: []descriptor{
+			{Digest: "sha256:abc", Size: 42},
+		},
+	})
+
+	ctx := newTestContext()
+	m, err := reg.client().getManifest(ctx, reg.host()+"/repository/svc", "1.0")
+	assert.NoError(err)
+	assert.Len(m.Layers, 1)
+	assert.Equal(int64(42), m.Layers[0].Size)
+
+	_, err = reg.client().getManifest(ctx, reg.host()+"/repository/svc", "2.0")
+	assert.Equal(errManifestNotFound, err)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	noneTag           = "<none>"
+	dockerTimeLayout  = "2006-01-02 15:04:05 -0700 MST"
+	imageListTemplate = "{{.ID}}\t{{.Repository}}\t{{.Tag}}\t{{.CreatedAt}}"
+)
+
+// RetentionPolicy decides which images of a target repository are removed after
+// a successful deployment. The last keepLast images and images younger than
+// keepFor are kept, as are images used by any container. With dryRun set the
+// images that would be removed are only recorded in the job.
+type RetentionPolicy struct {
+	KeepLast int           `yaml:"keepLast,omitempty"`
+	KeepFor  time.Duration `yaml:"keepFor,omitempty"`
+	DryRun   bool          `yaml:"dryRun,omitempty"`
+}
+
+func (p RetentionPolicy) validate() error {
+	if p.KeepLast < 0 || p.KeepFor < 0 {
+		return fmt.Errorf("retention keepLast and keepFor must not be negative")
+	}
+	return nil
+}
+
+// ImageInfo an image as listed by docker.
+type ImageInfo struct {
+	ID         string
+	Repository string
+	Tag        string
+	Created    time.Time
+}
+
+// reference returns the name to remove the image by, which is the tagged name
+// unless the image is untagged.
+func (i ImageInfo) reference() string {
+	if i.Tag == "" || i.Tag == noneTag {
+		return i.ID
+	}
+	return i.Repository + ":" + i.Tag
+}
+
+// RetentionResult images removed by a retention policy, recorded in the job.
+type RetentionResult struct {
+	DryRun  bool     `json:"dryRun,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Failed  []string `json:"failed,omitempty"`
+}
+
+// ListImages lists the local images of a repository.
+func (c *cliDockerClient) ListImages(ctx *Context, repository string) ([]ImageInfo, error) {
+	target := Target{
+		Binary: "docker",
+		Script: "image",
+	}
+
+	output, err := target.execute(ctx, "ls", "--no-trunc", "--format", imageListTemplate, repository)
+	if err != nil {
+		log.Errorw("Failed to list images", "repository", repository, "output", output, "error", err, "requestId", ctx.id)
+		return nil, err
+	}
+
+	var images []ImageInfo
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			continue
+		}
+
+		created, err := time.Parse(dockerTimeLayout, fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected image creation time %q", fields[3])
+		}
+		images = append(images, ImageInfo{
+			ID:         fields[0],
+			Repository: fields[1],
+			Tag:        fields[2],
+			Created:    created,
+		})
+	}
+
+	return images, nil
+}
+
+// ImagesInUse returns the ids of the images used by any container, running or not.
+func (c *cliDockerClient) ImagesInUse(ctx *Context) (map[string]bool, error) {
+	ps := Target{
+		Binary: "docker",
+		Script: "ps",
+	}
+
+	output, err := ps.execute(ctx, "-a", "-q")
+	if err != nil {
+		log.Errorw("Failed to list containers", "output", output, "error", err, "requestId", ctx.id)
+		return nil, err
+	}
+
+	inUse := make(map[string]bool)
+	if output == "" {
+		return inUse, nil
+	}
+
+	inspect := Target{
+		Binary: "docker",
+		Script: "inspect",
+	}
+	args := append([]string{"--type", "container", "--format", "{{.Image}}"}, strings.Fields(output)...)
+	output, err = inspect.execute(ctx, args...)
+	if err != nil {
+		log.Errorw("Failed to inspect containers", "output", output, "error", err, "requestId", ctx.id)
+		return nil, err
+	}
+
+	for _, id := range strings.Fields(output) {
+		inUse[id] = true
+	}
+	return inUse, nil
+}
+
+// expiredImages returns the images which the policy does not keep. Images are
+// ranked by creation time, and all tags of an image share its rank.
+func (p RetentionPolicy) expiredImages(images []ImageInfo, inUse map[string]bool, now time.Time) []ImageInfo {
+	sorted := append([]ImageInfo{}, images...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Created.After(sorted[j].Created)
+	})
+
+	keepLast := p.KeepLast
+	if keepLast == 0 {
+		keepLast = 1
+	}
+
+	ranks := make(map[string]int)
+	var expired []ImageInfo
+	for _, image := range sorted {
+		rank, ok := ranks[image.ID]
+		if !ok {
+			rank = len(ranks)
+			ranks[image.ID] = rank
+		}
+
+		switch {
+		case inUse[image.ID]:
+		case rank < keepLast:
+		case p.KeepFor > 0 && now.Sub(image.Created) < p.KeepFor:
+		default:
+			expired = append(expired, image)
+		}
+	}
+
+	return expired
+}
+
+// applyRetention removes the images of the deployed repository which are no
+// longer kept by the retention policy of the target. It may run both before
+// and after a deployment, and the removed images add up in the job.
+func (e *env) applyRetention(ctx *Context, target Target, job *Job) {
+	policy := *target.Retention
+	ref, err := parseImageRef(job.Image)
+	if err != nil {
+		return
+	}
+
+	images, err := e.docker.ListImages(ctx, ref.name)
+	if err != nil {
+		log.Warnw("Skipping image retention", "error", err, "requestId", ctx.id)
+		return
+	}
+
+	inUse, err := e.docker.ImagesInUse(ctx)
+	if err != nil {
+		log.Warnw("Skipping image retention", "error", err, "requestId", ctx.id)
+		return
+	}
+
+	result := job.Retention
+	if result == nil {
+		result = &RetentionResult{DryRun: policy.DryRun}
+		job.Retention = result
+	}
+	for _, image := range policy.expiredImages(images, inUse, time.Now()) {
+		name := image.reference()
+		if policy.DryRun {
+			log.Infow("Would remove image", "image", name, "requestId", ctx.id)
+			result.Removed = append(result.Removed, name)
+			continue
+		}
+
+		err = e.docker.RemoveImage(ctx, name)
+		if err != nil {
+			result.Failed = append(result.Failed, name)
+			continue
+		}
+		result.Removed = append(result.Removed, name)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionPolicy_expiredImages(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	images := []ImageInfo{
+		{ID: "sha256:a", Repository: "repository/svc", Tag: "1.0", Created: now.Add(-72 * time.Hour)},
+		{ID: "sha256:b", Repository: "repository/svc", Tag: "1.1", Created: now.Add(-48 * time.Hour)},
+		{ID: "sha256:c", Repository: "repository/svc", Tag: "1.2", Created: now.Add(-36 * time.Hour)},
+		{ID: "sha256:c", Repository: "repository/svc", Tag: "stable", Created: now.Add(-36 * time.Hour)},
+		{ID: "sha256:d", Repository: "repository/svc", Tag: noneTag, Created: now.Add(-30 * time.Hour)},
+		{ID: "sha256:e", Repository: "repository/svc", Tag: "1.3", Created: now.Add(-2 * time.Hour)},
+		{ID: "sha256:f", Repository: "repository/svc", Tag: "1.4", Created: now.Add(-time.Hour)},
+	}
+	inUse := map[string]bool{"sha256:a": true}
+
+	policy := RetentionPolicy{KeepLast: 2}
+	var removed []string
+	for _, image := range policy.expiredImages(images, inUse, now) {
+		removed = append(removed, image.reference())
+	}
+	assert.Equal([]string{"sha256:d", "repository/svc:1.2", "repository/svc:stable", "repository/svc:1.1"}, removed)
+
+	policy = RetentionPolicy{KeepFor: 40 * time.Hour}
+	removed = nil
+	for _, image := range policy.expiredImages(images, inUse, now) {
+		removed = append(removed, image.reference())
+	}
+	assert.Equal([]string{"repository/svc:1.1"}, removed)
+
+	assert.Error(RetentionPolicy{KeepLast: -1}.validate())
+}
+
+func TestRedeploy_retention(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	target := Target{
+		ID:        "test-svc",
+		Binary:    "/bin/sh",
+		Script:    "./resources/test-svc.sh",
+		Retention: &RetentionPolicy{KeepLast: 2, DryRun: true},
+	}
+
+	dc := &removingDockerClient{
+		mockDockerClient: mockDockerClient{
+			GetImageIDOutput: "repository/svc:1.0",
+			ListImagesOutput: []ImageInfo{
+				{ID: "sha256:a", Repository: "repository/svc", Tag: "0.9", Created: now.Add(-3 * time.Hour)},
+				{ID: "sha256:b", Repository: "repository/svc", Tag: "1.0", Created: now.Add(-2 * time.Hour)},
+				{ID: "sha256:c", Repository: "repository/svc", Tag: "1.1", Created: now.Add(-time.Hour)},
+			},
+		},
+	}
+	e := &env{docker: dc}
+
+	e.redeploy(newTestContext(), target, "repository/svc:1.1")
+	assert.Equal("repository/svc", dc.ListImagesArg)
+	assert.Empty(dc.removed)
+
+	target.Retention.DryRun = false
+	e.redeploy(newTestContext(), target, "repository/svc:1.1")
+	assert.Equal([]string{"repository/svc:0.9"}, dc.removed)
+}
+
+// removingDockerClient records every removed image.
+type removingDockerClient struct {
+	mockDockerClient
+	removed []string
+}
+
+func (c *removingDockerClient) RemoveImage(ctx *Context, image string) error {
+	c.removed = append(c.removed, image)
+	return nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidVersion    = fmt.Errorf("Invalid version")
+	errInvalidConstraint = fmt.Errorf("Invalid version constraint")
+)
+
+// VersionPolicy restricts which image versions may be deployed to a target.
+type VersionPolicy struct {
+	Constraint      string `yaml:"constraint,omitempty"`
+	AllowPrerelease bool   `yaml:"allowPrerelease,omitempty"`
+	DenyDowngrade   bool   `yaml:"denyDowngrade,omitempty"`
+}
+
+func (p VersionPolicy) validate() error {
+	_, err := parseConstraint(p.Constraint)
+	return err
+}
+
+// check verifies that a version is allowed by the policy. Current may be empty if
+// no version of the target is currently running.
+func (p VersionPolicy) check(version, current string) error {
+	err := p.allows(version)
+	if err != nil {
+		return err
+	}
+	return p.checkDowngrade(version, current)
+}
+
+// allows verifies that a version satisfies the constraint of the policy, without
+// regard to the version currently running.
+func (p VersionPolicy) allows(version string) error {
+	v, err := parseVersion(version)
+	if err != nil {
+		return fmt.Errorf("image tag %q is not a semantic version", version)
+	}
+
+	if v.pre != "" && !p.AllowPrerelease {
+		return fmt.Errorf("pre-release version %s is not allowed", version)
+	}
+
+	c, err := parseConstraint(p.Constraint)
+	if err != nil {
+		return err
+	}
+
+	if !c.matches(v) {
+		return fmt.Errorf("version %s does not satisfy constraint %q", version, p.Constraint)
+	}
+
+	return nil
+}
+
+// checkDowngrade verifies that a version is not older than the current one, if
+// the policy denies downgrades.
+func (p VersionPolicy) checkDowngrade(version, current string) error {
+	if !p.DenyDowngrade || current == "" {
+		return nil
+	}
+
+	v, err := parseVersion(version)
+	if err != nil {
+		return fmt.Errorf("image tag %q is not a semantic version", version)
+	}
+
+	cv, err := parseVersion(current)
+	if err != nil {
+		log.Warnw("Running version is not a semantic version, skipping downgrade check", "version", current)
+		return nil
+	}
+
+	if v.compare(cv) < 0 {
+		return fmt.Errorf("version %s is a downgrade from the running version %s", version, current)
+	}
+
+	return nil
+}
+
+type version struct {
+	major int
+	minor int
+	patch int
+	pre   string
+}
+
+// parseVersion parses a semantic version. A leading "v" as well as missing minor
+// and patch components are accepted, build metadata is ignored.
+func parseVersion(str string) (version, error) {
+	str = strings.TrimPrefix(str, "v")
+	if i := strings.Index(str, "+"); i != -1 {
+		str = str[:i]
+	}
+
+	var v version
+	if i := strings.Index(str, "-"); i != -1 {
+		v.pre = str[i+1:]
+		str = str[:i]
+		if v.pre == "" {
+			return version{}, errInvalidVersion
+		}
+	}
+
+	parts := strings.Split(str, ".")
+	if len(parts) > 3 {
+		return version{}, errInvalidVersion
+	}
+
+	nums := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return version{}, errInvalidVersion
+		}
+		nums[i] = n
+	}
+
+	v.major, v.minor, v.patch = nums[0], nums[1], nums[2]
+	return v, nil
+}
+
+// compare returns -1, 0 or 1 if v is less than, equal to or greater than other
+// according to semantic versioning precedence.
+func (v version) compare(other version) int {
+	if c := compareInt(v.major, other.major); c != 0 {
+		return c
+	}
+	if c := compareInt(v.minor, other.minor); c != 0 {
+		return c
+	}
+	if c := compareInt(v.patch, other.patch); c != 0 {
+		return c
+	}
+
+	return comparePrerelease(v.pre, other.pre)
+}
+
+func (v version) String() string {
+	str := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if v.pre != "" {
+		str += "-" + v.pre
+	}
+	return str
+}
+
+func comparePrerelease(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return 1
+	}
+	if b == "" {
+		return -1
+	}
+
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNum, aErr := strconv.Atoi(aParts[i])
+		bNum, bErr := strconv.Atoi(bParts[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if c := compareInt(aNum, bNum); c != 0 {
+				return c
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(aParts[i], bParts[i]); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return compareInt(len(aParts), len(bParts))
+}
+
+func compareInt(a, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// constraint is a set of alternatives separated by "||", each of which is a
+// list of comparisons that must all hold, e.g. ">=1.4.0 <1.5.0 || ^2.1".
+type constraint [][]comparison
+
+type comparison struct {
+	op string
+	v  version
+}
+
+func (c constraint) matches(v version) bool {
+	if len(c) == 0 {
+		return true
+	}
+
+	for _, comparisons := range c {
+		ok := true
+		for _, cmp := range comparisons {
+			if !cmp.matches(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c comparison) matches(v version) bool {
+	// Pre-release precedence is ignored when checking ranges so that a pre-release
+	// of 1.5.0 is not considered to be within "<1.5.0".
+	if v.pre != "" && c.v.pre == "" && c.op != "=" && c.op != "!=" {
+		v.pre = ""
+		if v.compare(c.v) == 0 {
+			return c.op == "<="
+		}
+	}
+
+	cmp := v.compare(c.v)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+
+	return false
+}
+
+func parseConstraint(str string) (constraint, error) {
+	if strings.TrimSpace(str) == "" {
+		return nil, nil
+	}
+
+	var c constraint
+	for _, alternative := range strings.Split(str, "||") {
+		terms := strings.FieldsFunc(alternative, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+		if len(terms) == 0 {
+			return nil, errInvalidConstraint
+		}
+
+		var comparisons []comparison
+		for _, term := range terms {
+			cmps, err := parseComparison(term)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %q", errInvalidConstraint, term)
+			}
+			comparisons = append(comparisons, cmps...)
+		}
+		c = append(c, comparisons)
+	}
+
+	return c, nil
+}
+
+func parseComparison(term string) ([]comparison, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", "!=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(term, prefix) {
+			op = prefix
+			break
+		}
+	}
+	str := strings.TrimPrefix(term, op)
+
+	if isWildcard(str) {
+		if op != "" {
+			return nil, errInvalidConstraint
+		}
+		return parseWildcard(str)
+	}
+
+	v, err := parseVersion(str)
+	if err != nil {
+		return nil, err
+	}
+	specified := len(strings.Split(strings.SplitN(strings.TrimPrefix(str, "v"), "-", 2)[0], "."))
+
+	switch op {
+	case "", "=":
+		return []comparison{{op: "=", v: v}}, nil
+	case "~":
+		upper := version{major: v.major, minor: v.minor + 1}
+		if specified == 1 {
+			upper = version{major: v.major + 1}
+		}
+		return []comparison{{op: ">=", v: v}, {op: "<", v: upper}}, nil
+	case "^":
+		var upper version
+		switch {
+		case v.major != 0 || specified == 1:
+			upper = version{major: v.major + 1}
+		case v.minor != 0 || specified == 2:
+			upper = version{minor: v.minor + 1}
+		default:
+			upper = version{patch: v.patch + 1}
+		}
+		return []comparison{{op: ">=", v: v}, {op: "<", v: upper}}, nil
+	}
+
+	return []comparison{{op: op, v: v}}, nil
+}
+
+func isWildcard(str string) bool {
+	for _, part := range strings.Split(str, ".") {
+		if part == "x" || part == "X" || part == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWildcard turns "1.4.x" into ">=1.4.0 <1.5.0" and "1.x" into ">=1.0.0 <2.0.0".
+func parseWildcard(str string) ([]comparison, error) {
+	parts := strings.Split(strings.TrimPrefix(str, "v"), ".")
+	if len(parts) > 3 {
+		return nil, errInvalidConstraint
+	}
+
+	nums := make([]int, 0, 3)
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			for _, rest := range parts[i+1:] {
+				if rest != "x" && rest != "X" && rest != "*" {
+					return nil, errInvalidConstraint
+				}
+			}
+			break
+		}
+
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, errInvalidConstraint
+		}
+		nums = append(nums, n)
+	}
+
+	switch len(nums) {
+	case 0:
+		return nil, nil
+	case 1:
+		return []comparison{
+			{op: ">=", v: version{major: nums[0]}},
+			{op: "<", v: version{major: nums[0] + 1}},
+		}, nil
+	default:
+		return []comparison{
+			{op: ">=", v: version{major: nums[0], minor: nums[1]}},
+			{op: "<", v: version{major: nums[0], minor: nums[1] + 1}},
+		}, nil
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	v, err := parseVersion("v1.4.2-rc.1+build.5")
+	assert.NoError(err)
+	assert.Equal(version{major: 1, minor: 4, patch: 2, pre: "rc.1"}, v)
+
+	v, err = parseVersion("1.4")
+	assert.NoError(err)
+	assert.Equal(version{major: 1, minor: 4}, v)
+
+	_, err = parseVersion("latest")
+	assert.Equal(errInvalidVersion, err)
+
+	_, err = parseVersion("1.2.3.4")
+	assert.Equal(errInvalidVersion, err)
+
+	_, err = parseVersion("1.2.3-")
+	assert.Equal(errInvalidVersion, err)
+}
+
+func TestVersionCompare(t *testing.T) {
+	assert := assert.New(t)
+
+	ordered := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.2.0",
+		"2.0.0",
+	}
+
+	for i := 0; i < len(ordered)-1; i++ {
+		a, err := parseVersion(ordered[i])
+		assert.NoError(err)
+		b, err := parseVersion(ordered[i+1])
+		assert.NoError(err)
+
+		assert.Equal(-1, a.compare(b), "%s < %s", a, b)
+		assert.Equal(1, b.compare(a), "%s > %s", b, a)
+		assert.Equal(0, a.compare(a))
+	}
+}
+
+func TestConstraintMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		constraint string
+		version    string
+		expected   bool
+	}{
+		{"", "0.0.1", true},
+		{"1.4.2", "1.4.2", true},
+		{"1.4.2", "1.4.3", false},
+		{">=1.4.0 <1.5.0", "1.4.9", true},
+		{">=1.4.0, <1.5.0", "1.5.0", false},
+		{"~1.4", "1.4.7", true},
+		{"~1.4", "1.5.0", false},
+		{"~1.4.2", "1.4.1", false},
+		{"~1", "1.9.0", true},
+		{"^1.4.2", "1.9.0", true},
+		{"^1.4.2", "2.0.0", false},
+		{"^0.4.2", "0.4.9", true},
+		{"^0.4.2", "0.5.0", false},
+		{"^0.0.3", "0.0.4", false},
+		{"1.4.x", "1.4.11", true},
+		{"1.4.x", "1.3.11", false},
+		{"1.x", "1.99.0", true},
+		{"*", "3.0.0", true},
+		{"!=1.4.3", "1.4.3", false},
+		{"<1.0.0 || >=2.0.0", "1.5.0", false},
+		{"<1.0.0 || >=2.0.0", "2.1.0", true},
+		{"~1.4", "1.5.0-rc.1", false},
+		{">=1.4.0", "1.4.0-rc.1", false},
+		{"<=1.4.0", "1.4.0-rc.1", true},
+		{"~1.4", "1.4.3-rc.1", true},
+	}
+
+	for _, c := range cases {
+		con, err := parseConstraint(c.constraint)
+		assert.NoError(err, c.constraint)
+		v, err := parseVersion(c.version)
+		assert.NoError(err, c.version)
+		assert.Equal(c.expected, con.matches(v), "%s matches %s", c.constraint, c.version)
+	}
+
+	for _, invalid := range []string{">=abc", "~1.x", "1.x.2", "1.4.0 ||"} {
+		_, err := parseConstraint(invalid)
+		assert.Error(err, invalid)
+	}
+}
+
+func TestVersionPolicyCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := VersionPolicy{
+		Constraint:    "~1.4",
+		DenyDowngrade: true,
+	}
+
+	assert.NoError(policy.check("1.4.3", "1.4.2"))
+	assert.NoError(policy.check("1.4.3", ""))
+	assert.NoError(policy.check("1.4.3", "latest"))
+	assert.Error(policy.check("1.4.1", "1.4.2"))
+	assert.Error(policy.check("1.5.0", "1.4.2"))
+	assert.Error(policy.check("1.4.4-rc.1", "1.4.2"))
+	assert.Error(policy.check("latest", "1.4.2"))
+
+	policy.AllowPrerelease = true
+	assert.NoError(policy.check("1.4.4-rc.1", "1.4.2"))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	cosignSignatureType       = "cosign container image signature"
+)
+
+var (
+	errImageNotVerified = fmt.Errorf("Image signature verification failed")
+	errInvalidPublicKey = fmt.Errorf("Invalid public key")
+)
+
+// SignaturePolicy requires images deployed to a target to carry a cosign
+// compatible signature made by one of the configured public keys.
+type SignaturePolicy struct {
+	PublicKeys []string `yaml:"publicKeys,omitempty"`
+}
+
+func (p SignaturePolicy) loadKeys() ([]crypto.PublicKey, error) {
+	if len(p.PublicKeys) == 0 {
+		return nil, errInvalidPublicKey
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(p.PublicKeys))
+	for _, path := range p.PublicKeys {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := parsePublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", err, path)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func parsePublicKey(raw []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errInvalidPublicKey
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errInvalidPublicKey
+	}
+
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+
+	return nil, errInvalidPublicKey
+}
+
+// simpleSigning payload signed by cosign.
+type simpleSigning struct {
+	Critical struct {
+		Type  string `json:"type"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verifySignature checks that the registry holds a valid signature for the image
+// digest made by one of the keys in the policy. Signatures are looked up the way
+// cosign stores them, as the tag sha256-<hex>.sig in the image repository.
+// verifiedImage resolves the digest of the image of a job and verifies its
+// signature if required by the target, for targets which do not pull the image
+// themselves. The returned reference names the verified digest, so that the
+// deployed image cannot change after verification.
+func (e *env) verifiedImage(ctx *Context, target Target, job *Job) (string, error) {
+	if target.Signature == nil {
+		return job.Image, nil
+	}
+
+	pinned, err := e.pinDigest(ctx, job.Image)
+	if err != nil {
+		log.Errorw("Failed to resolve image digest", "image", job.Image, "error", err, "requestId", ctx.id)
+		return "", errImageNotVerified
+	}
+	ref, err := parseImageRef(pinned)
+	if err != nil {
+		return "", err
+	}
+	job.Digest = ref.digest
+
+	err = e.verifySignature(ctx, *target.Signature, job.Image, job.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	return ref.name + "@" + ref.digest, nil
+}
+
+func (e *env) verifySignature(ctx *Context, policy SignaturePolicy, image, digest string) error {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return err
+	}
+
+	if !digestPattern.MatchString(digest) {
+		log.Errorw("Cannot verify signature without image digest", "image", image, "requestId", ctx.id)
+		return errImageNotVerified
+	}
+
+	keys, err := policy.loadKeys()
+	if err != nil {
+		log.Errorw("Failed to load public keys", "error", err, "requestId", ctx.id)
+		return errImageNotVerified
+	}
+
+	sigTag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	m, err := e.registry.getManifest(ctx, ref.name, sigTag)
+	if err != nil {
+		log.Errorw("Failed to fetch image signatures", "image", image, "tag", sigTag, "error", err, "requestId", ctx.id)
+		return errImageNotVerified
+	}
+
+	for _, layer := range m.Layers {
+		encoded, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+
+		payload, err := e.registry.getBlob(ctx, ref.name, layer.Digest)
+		if err != nil {
+			log.Warnw("Failed to fetch signature payload", "digest", layer.Digest, "error", err, "requestId", ctx.id)
+			continue
+		}
+
+		err = verifyPayload(payload, layer.Digest, encoded, digest, keys)
+		if err != nil {
+			log.Warnw("Invalid image signature", "digest", layer.Digest, "error", err, "requestId", ctx.id)
+			continue
+		}
+
+		log.Infow("Image signature verified", "image", image, "digest", digest, "requestId", ctx.id)
+		return nil
+	}
+
+	log.Errorw("No valid signature found for image", "image", image, "digest", digest, "requestId", ctx.id)
+	return errImageNotVerified
+}
+
+func verifyPayload(payload []byte, payloadDigest, encodedSig, imageDigest string, keys []crypto.PublicKey) error {
+	sum := sha256.Sum256(payload)
+	if "sha256:"+hex.EncodeToString(sum[:]) != payloadDigest {
+		return fmt.Errorf("payload does not match its digest")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return fmt.Errorf("malformed signature")
+	}
+
+	if !verifyWithAny(keys, payload, sum[:], sig) {
+		return fmt.Errorf("signature not made by a trusted key")
+	}
+
+	var body simpleSigning
+	err = json.Unmarshal(payload, &body)
+	if err != nil {
+		return fmt.Errorf("malformed payload")
+	}
+
+	if body.Critical.Type != cosignSignatureType {
+		return fmt.Errorf("unexpected payload type %q", body.Critical.Type)
+	}
+
+	if body.Critical.Image.DockerManifestDigest != imageDigest {
+		return fmt.Errorf("signature is for digest %s", body.Critical.Image.DockerManifestDigest)
+	}
+
+	return nil
+}
+
+func verifyWithAny(keys []crypto.PublicKey, payload, hash, sig []byte) bool {
+	for _, key := range keys {
+		switch k := key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(k, hash, sig) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, hash, sig) == nil {
+				return true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, payload, sig) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySignature(t *testing.T) {
+	assert := assert.New(t)
+	reg := newTestRegistry()
+	defer reg.server.Close()
+
+	dir, err := ioutil.TempDir("", "redeployer-signature")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	trusted, trustedPath := createTestKey(t, dir, "trusted.pub")
+	untrusted, _ := createTestKey(t, dir, "untrusted.pub")
+	policy := SignaturePolicy{PublicKeys: []string{trustedPath}}
+
+	signed := "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	unsigned := "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	wrongKey := "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	otherImage := "sha256:4444444444444444444444444444444444444444444444444444444444444444"
+
+	addTestSignature(reg, "repository/svc", signed, signed, trusted)
+	addTestSignature(reg, "repository/svc", wrongKey, wrongKey, untrusted)
+	addTestSignature(reg, "repository/svc", otherImage, signed, trusted)
+
+	e := &env{registry: reg.client()}
+	ctx := newTestContext()
+	image := reg.host() + "/repository/svc:1.0"
+
+	assert.NoError(e.verifySignature(ctx, policy, image, signed))
+	assert.Equal(errImageNotVerified, e.verifySignature(ctx, policy, image, unsigned))
+	assert.Equal(errImageNotVerified, e.verifySignature(ctx, policy, image, wrongKey))
+	assert.Equal(errImageNotVerified, e.verifySignature(ctx, policy, image, otherImage))
+	assert.Equal(errImageNotVerified, e.verifySignature(ctx, policy, image, ""))
+
+	missingKey := SignaturePolicy{PublicKeys: []string{filepath.Join(dir, "missing.pub")}}
+	assert.Equal(errImageNotVerified, e.verifySignature(ctx, missingKey, image, signed))
+}
+
+func createTestKey(t *testing.T, dir, name string) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, path
+}
+
+// addTestSignature stores a cosign style signature of signedDigest under the
+// signature tag of imageDigest.
+func addTestSignature(reg *testRegistry, repo, imageDigest, signedDigest string, key *ecdsa.PrivateKey) {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"%s"},"image":{"docker-manifest-digest":"%s"},"type":"%s"},"optional":null}`, repo, signedDigest, cosignSignatureType))
+	sum := sha256.Sum256(payload)
+	payloadDigest := "sha256:" + hex.EncodeToString(sum[:])
+
+	sig, _ := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	reg.addBlob(repo, payloadDigest, payload)
+	reg.addManifest(repo, "sha256-"+imageDigest[len("sha256:"):]+".sig", manifest{
+		MediaType: mediaTypeOCIManifest,
+		Layers: []descriptor{
+			{
+				MediaType: "application/vnd.dev.cosign.simplesigning.v1+json",
+				Digest:    payloadDigest,
+				Size:      int64(len(payload)),
+				Annotations: map[string]string{
+					cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+				},
+			},
+		},
+	})
+}
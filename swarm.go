@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	typeSwarm = "swarm"
+
+	defaultConvergeTimeout = 10 * time.Minute
+	swarmPollInterval      = 2 * time.Second
+)
+
+// Swarm service update states.
+const (
+	updateCompleted         = "completed"
+	updatePaused            = "paused"
+	updateRollbackCompleted = "rollback_completed"
+	updateRollbackPaused    = "rollback_paused"
+)
+
+var (
+	errUpdatePaused     = fmt.Errorf("Service update paused")
+	errUpdateRolledBack = fmt.Errorf("Service update rolled back")
+	errUpdateTimeout    = fmt.Errorf("Service did not converge")
+)
+
+// Swarm identifies a docker swarm service and configures how updates of it are
+// rolled out. Unset update options keep the ones already set on the service.
+type Swarm struct {
+	Service       string        `yaml:"service,omitempty"`
+	Parallelism   int           `yaml:"parallelism,omitempty"`
+	Delay         time.Duration `yaml:"delay,omitempty"`
+	FailureAction string        `yaml:"failureAction,omitempty"`
+	Monitor       time.Duration `yaml:"monitor,omitempty"`
+	Timeout       time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (s Swarm) validate() error {
+	if s.Service == "" {
+		return fmt.Errorf("swarm targets require service")
+	}
+
+	switch s.FailureAction {
+	case "", "pause", "continue", "rollback":
+		return nil
+	}
+	return fmt.Errorf("invalid failure action %q", s.FailureAction)
+}
+
+// updateArgs returns the arguments for docker service update. The update is
+// forced so that redeploying the current image still replaces its tasks.
+func (s Swarm) updateArgs(image string) []string {
+	args := []string{"--detach", "--force", "--with-registry-auth", "--image", image}
+	if s.Parallelism > 0 {
+		args = append(args, "--update-parallelism", strconv.Itoa(s.Parallelism))
+	}
+	if s.Delay > 0 {
+		args = append(args, "--update-delay", s.Delay.String())
+	}
+	if s.FailureAction != "" {
+		args = append(args, "--update-failure-action", s.FailureAction)
+	}
+	if s.Monitor > 0 {
+		args = append(args, "--update-monitor", s.Monitor.String())
+	}
+
+	return append(args, s.Service)
+}
+
+// ServiceImage returns the image in the spec of a swarm service.
+func (c *cliDockerClient) ServiceImage(ctx *Context, name string) (string, error) {
+	log.Debugw("Retrieving service image", "name", name, "requestId", ctx.id)
+	target := Target{
+		Binary: "docker",
+		Script: "service",
+	}
+
+	output, err := target.execute(ctx, "inspect", "--format", "{{.Spec.TaskTemplate.ContainerSpec.Image}}", name)
+	if err != nil {
+		log.Errorw("Failed to inspect service", "output", output, "error", err, "requestId", ctx.id)
+	}
+
+	return output, err
+}
+
+// UpdateService starts a rolling update of a swarm service to a new image.
+func (c *cliDockerClient) UpdateService(ctx *Context, cfg Swarm, image string) (string, error) {
+	log.Debugw("Updating service", "name", cfg.Service, "image", image, "requestId", ctx.id)
+	env, cleanup, err := c.registryEnv(ctx, image)
+	defer cleanup()
+	if err != nil {
+		return "", err
+	}
+
+	target := Target{
+		Binary: "docker",
+		Script: "service",
+	}
+
+	args := append([]string{"update"}, cfg.updateArgs(image)...)
+	output, err := target.executeWithEnv(ctx, env, args...)
+	if err != nil {
+		log.Errorw("Failed to update service", "output", output, "error", err, "requestId", ctx.id)
+	}
+
+	return output, err
+}
+
+// ServiceUpdateStatus status of the latest update of a swarm service, which is
+// empty if the service has never been updated.
+type ServiceUpdateStatus struct {
+	State     string    `json:"State"`
+	StartedAt time.Time `json:"StartedAt"`
+}
+
+// ServiceUpdateStatus returns the status of the latest update of a swarm service.
+func (c *cliDockerClient) ServiceUpdateStatus(ctx *Context, name string) (ServiceUpdateStatus, error) {
+	target := Target{
+		Binary: "docker",
+		Script: "service",
+	}
+
+	var status ServiceUpdateStatus
+	output, err := target.execute(ctx, "inspect", "--format", "{{json .UpdateStatus}}", name)
+	if err != nil {
+		log.Errorw("Failed to inspect service update", "output", output, "error", err, "requestId", ctx.id)
+		return status, err
+	}
+
+	err = json.Unmarshal([]byte(output), &status)
+	return status, err
+}
+
+func (e *env) redeploySwarm(ctx *Context, target Target, job *Job) {
+	cfg := *target.Swarm
+	image, err := e.verifiedImage(ctx, target, job)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+
+	previous, err := e.docker.ServiceImage(ctx, cfg.Service)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+	job.Previous = previous
+
+	before, err := e.docker.ServiceUpdateStatus(ctx, cfg.Service)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+
+	output, err := e.docker.UpdateService(ctx, cfg, image)
+	job.setOutput(output)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+
+	err = e.waitForConvergence(ctx, cfg, before)
+	switch err {
+	case nil:
+	case errUpdateRolledBack:
+		job.Status = jobRolledBack
+		job.Error = secrets.redact(err.Error())
+		log.Warnw("Service update was rolled back", "service", cfg.Service, "previous", previous, "requestId", ctx.id)
+	default:
+		job.fail(err)
+		log.Errorw("Service update failed", "service", cfg.Service, "error", err, "requestId", ctx.id)
+	}
+}
+
+// waitForConvergence polls the update status of a service until the update
+// started after the given status has completed, or been paused or rolled back by
+// swarm. The status from before the update is ignored, so that the outcome of a
+// previous update is not mistaken for the outcome of this one.
+func (e *env) waitForConvergence(ctx *Context, cfg Swarm, before ServiceUpdateStatus) error {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultConvergeTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		status, err := e.docker.ServiceUpdateStatus(ctx, cfg.Service)
+		if err != nil {
+			return err
+		}
+
+		if status.StartedAt.After(before.StartedAt) {
+			switch status.State {
+			case updateCompleted:
+				return nil
+			case updatePaused, updateRollbackPaused:
+				return errUpdatePaused
+			case updateRollbackCompleted:
+				return errUpdateRolledBack
+			}
+		}
+
+		log.Debugw("Waiting for service to converge", "service", cfg.Service, "state", status.State, "requestId", ctx.id)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(swarmPollInterval):
+		}
+	}
+
+	return errUpdateTimeout
+}
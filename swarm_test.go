@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedeploySwarm(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := Swarm{
+		Service:       "svc",
+		Parallelism:   1,
+		FailureAction: "rollback",
+	}
+	target := Target{
+		ID:    "test-svc",
+		Type:  typeSwarm,
+		Swarm: &cfg,
+	}
+	previous := ServiceUpdateStatus{State: updateCompleted, StartedAt: time.Now().Add(-time.Hour)}
+	dc := &mockDockerClient{
+		ServiceImageOutput: "repository/svc:1.0",
+		ServiceUpdates:     swarmUpdates(previous, updateCompleted),
+	}
+	e := &env{docker: dc}
+
+	job := newJob(newTestContext(), target, "repository/svc:1.1")
+	e.redeploySwarm(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Equal("repository/svc:1.0", job.Previous)
+	assert.Equal("svc", dc.ServiceImageArg)
+	assert.Equal(cfg, dc.UpdateServiceArg)
+	assert.Equal("repository/svc:1.1", dc.UpdateServiceImage)
+	assert.Equal("", dc.RemoveContainerArg)
+
+	dc.ServiceUpdates = swarmUpdates(previous, updateRollbackCompleted)
+	job = newJob(newTestContext(), target, "repository/svc:1.2")
+	e.redeploySwarm(newTestContext(), target, job)
+	assert.Equal(jobRolledBack, job.Status)
+	assert.Equal(errUpdateRolledBack.Error(), job.Error)
+
+	dc.ServiceUpdates = swarmUpdates(previous, updatePaused)
+	job = newJob(newTestContext(), target, "repository/svc:1.2")
+	e.redeploySwarm(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal(errUpdatePaused.Error(), job.Error)
+}
+
+func TestWaitForConvergence_previousUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := Swarm{Service: "svc", Timeout: time.Minute}
+	previous := ServiceUpdateStatus{State: updateCompleted, StartedAt: time.Now().Add(-time.Hour)}
+	rolledBack := ServiceUpdateStatus{State: updateRollbackCompleted, StartedAt: previous.StartedAt}
+	for _, status := range []ServiceUpdateStatus{previous, rolledBack} {
+		e := &env{docker: &mockDockerClient{ServiceUpdates: []ServiceUpdateStatus{status}}}
+		ctx, cancel := newTestContext().withTimeout(100 * time.Millisecond)
+		start := time.Now()
+		assert.Equal(context.DeadlineExceeded, e.waitForConvergence(ctx, cfg, previous))
+		assert.True(time.Since(start) < 5*time.Second)
+		cancel()
+	}
+}
+
+// swarmUpdates returns the status before an update followed by the status of
+// the update, which ends in the given state.
+func swarmUpdates(before ServiceUpdateStatus, state string) []ServiceUpdateStatus {
+	started := before.StartedAt.Add(time.Hour)
+	return []ServiceUpdateStatus{before, {State: state, StartedAt: started}}
+}
+
+func TestSwarmUpdateArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := Swarm{Service: "svc"}
+	assert.Equal([]string{"--detach", "--force", "--with-registry-auth", "--image", "repository/svc:1.1", "svc"}, cfg.updateArgs("repository/svc:1.1"))
+
+	cfg = Swarm{
+		Service:       "svc",
+		Parallelism:   2,
+		Delay:         10 * time.Second,
+		FailureAction: "rollback",
+		Monitor:       5 * time.Second,
+	}
+	expected := []string{
+		"--detach", "--force", "--with-registry-auth", "--image", "repository/svc:1.1",
+		"--update-parallelism", "2",
+		"--update-delay", "10s",
+		"--update-failure-action", "rollback",
+		"--update-monitor", "5s",
+		"svc",
+	}
+	assert.Equal(expected, cfg.updateArgs("repository/svc:1.1"))
+
+	assert.Error(Swarm{Service: "svc", FailureAction: "explode"}.validate())
+}
+
+func TestRedeploySwarm_signature(t *testing.T) {
+	assert := assert.New(t)
+	reg := newTestRegistry()
+	defer reg.server.Close()
+
+	dir, err := ioutil.TempDir("", "redeployer-swarm")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	m := manifest{MediaType: mediaTypeOCIManifest}
+	reg.addManifest("repository/svc", "1.1", m)
+	raw, _ := json.Marshal(m)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(raw))
+	key, keyPath := createTestKey(t, dir, "trusted.pub")
+	addTestSignature(reg, "repository/svc", digest, digest, key)
+
+	target := Target{
+		ID:        "test-svc",
+		Type:      typeSwarm,
+		Swarm:     &Swarm{Service: "svc"},
+		Signature: &SignaturePolicy{PublicKeys: []string{keyPath}},
+	}
+	dc := &mockDockerClient{
+		ServiceUpdates: swarmUpdates(ServiceUpdateStatus{}, updateCompleted),
+	}
+	e := &env{docker: dc, registry: reg.client()}
+
+	job := newJob(newTestContext(), target, reg.host()+"/repository/svc:1.1")
+	e.redeploySwarm(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Equal(digest, job.Digest)
+	assert.Equal(reg.host()+"/repository/svc@"+digest, dc.UpdateServiceImage)
+}
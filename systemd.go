@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	typeSystemd = "systemd"
+
+	unitActive = "active"
+	unitFailed = "failed"
+
+	currentRelease         = "current"
+	dropInFile             = "redeployer.conf"
+	defaultSystemdDir      = "/etc/systemd/system"
+	defaultActiveTimeout   = 30 * time.Second
+	defaultDownloadTimeout = 10 * time.Minute
+	unitPollInterval       = 500 * time.Millisecond
+)
+
+var (
+	errInvalidRelease   = fmt.Errorf("Invalid release version")
+	errUnitNotActive    = fmt.Errorf("Unit did not become active")
+	errChecksumMismatch = fmt.Errorf("Artifact checksum mismatch")
+
+	releasePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+	sha256Pattern  = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+	// reservedReleases names in the release dir which are not release versions.
+	reservedReleases = map[string]bool{
+		currentRelease: true,
+	}
+)
+
+// Systemd configures deployment of a binary run by a systemd unit. Releases are
+// downloaded from the artifact URL, where {version} is replaced with the version
+// in the redeployment request, into a versioned directory under the release dir.
+// The artifact is verified against the sha256 checksum published at the checksum
+// URL, in the format of sha256sum. If the unit fails to start the previous
+// drop-in is restored.
+type Systemd struct {
+	Unit            string        `yaml:"unit,omitempty"`
+	ArtifactURL     string        `yaml:"artifactUrl,omitempty"`
+	ChecksumURL     string        `yaml:"checksumUrl,omitempty"`
+	ReleaseDir      string        `yaml:"releaseDir,omitempty"`
+	Binary          string        `yaml:"binary,omitempty"`
+	Args            string        `yaml:"args,omitempty"`
+	DropInDir       string        `yaml:"dropInDir,omitempty"`
+	Timeout         time.Duration `yaml:"timeout,omitempty"`
+	DownloadTimeout time.Duration `yaml:"downloadTimeout,omitempty"`
+}
+
+func (s Systemd) validate() error {
+	if s.Unit == "" || s.ArtifactURL == "" || s.ChecksumURL == "" || s.ReleaseDir == "" || s.Binary == "" {
+		return fmt.Errorf("systemd targets require unit, artifactUrl, checksumUrl, releaseDir and binary")
+	}
+	return nil
+}
+
+func (s Systemd) dropInDir() string {
+	if s.DropInDir != "" {
+		return s.DropInDir
+	}
+	return filepath.Join(defaultSystemdDir, s.Unit+".d")
+}
+
+func (s Systemd) dropIn(version string) string {
+	execStart := strings.TrimSpace(filepath.Join(s.ReleaseDir, version, s.Binary) + " " + s.Args)
+	return fmt.Sprintf("[Service]\nEnvironment=RELEASE_VERSION=%s\nExecStart=\nExecStart=%s\n", version, execStart)
+}
+
+// ServiceManager interface for controlling systemd units.
+type ServiceManager interface {
+	DaemonReload(ctx *Context) error
+	Restart(ctx *Context, unit string) error
+	IsActive(ctx *Context, unit string) (string, error)
+}
+
+type systemctlClient struct{}
+
+func (c *systemctlClient) DaemonReload(ctx *Context) error {
+	log.Debugw("Reloading systemd units", "requestId", ctx.id)
+	target := Target{
+		Binary: "systemctl",
+		Script: "daemon-reload",
+	}
+
+	output, err := target.execute(ctx)
+	if err != nil {
+		log.Errorw("Failed to reload systemd units", "output", output, "error", err, "requestId", ctx.id)
+	}
+
+	return err
+}
+
+func (c *systemctlClient) Restart(ctx *Context, unit string) error {
+	log.Debugw("Restarting unit", "unit", unit, "requestId", ctx.id)
+	target := Target{
+		Binary: "systemctl",
+		Script: "restart",
+	}
+
+	output, err := target.execute(ctx, unit)
+	if err != nil {
+		log.Errorw("Failed to restart unit", "unit", unit, "output", output, "error", err, "requestId", ctx.id)
+	}
+
+	return err
+}
+
+// IsActive returns the active state of a unit. Systemctl exits non zero for any
+// state other than active, so only missing output is treated as an error.
+func (c *systemctlClient) IsActive(ctx *Context, unit string) (string, error) {
+	target := Target{
+		Binary: "systemctl",
+		Script: "is-active",
+	}
+
+	output, err := target.execute(ctx, unit)
+	if output == "" {
+		return "", err
+	}
+
+	return output, nil
+}
+
+func (e *env) redeploySystemd(ctx *Context, target Target, job *Job) {
+	cfg := *target.Systemd
+	version := job.Image
+	job.Tag = version
+	if !releasePattern.MatchString(version) || reservedReleases[version] {
+		job.fail(errInvalidRelease)
+		return
+	}
+
+	previous, err := os.Readlink(filepath.Join(cfg.ReleaseDir, currentRelease))
+	if err == nil {
+		job.Previous = filepath.Base(previous)
+	}
+
+	job.Digest, err = e.installRelease(ctx, cfg, version)
+	if err != nil {
+		job.fail(err)
+		log.Errorw("Failed to install release", "version", version, "error", err, "requestId", ctx.id)
+		return
+	}
+
+	dropInPath := filepath.Join(cfg.dropInDir(), dropInFile)
+	previousDropIn, err := ioutil.ReadFile(dropInPath)
+	if err != nil && !os.IsNotExist(err) {
+		job.fail(err)
+		log.Errorw("Failed to read unit drop-in", "error", err, "requestId", ctx.id)
+		return
+	}
+
+	err = writeFileAtomic(dropInPath, []byte(cfg.dropIn(version)), 0644)
+	if err != nil {
+		job.fail(err)
+		log.Errorw("Failed to write unit drop-in", "error", err, "requestId", ctx.id)
+		return
+	}
+
+	err = e.systemd.DaemonReload(ctx)
+	if err == nil {
+		err = e.systemd.Restart(ctx, cfg.Unit)
+	}
+	if err == nil {
+		err = e.waitForUnit(ctx, cfg)
+	}
+	if err != nil {
+		job.fail(err)
+		log.Errorw("Unit failed to start", "unit", cfg.Unit, "previous", job.Previous, "requestId", ctx.id)
+		e.rollbackSystemd(ctx, cfg, job, previousDropIn)
+		return
+	}
+
+	err = linkRelease(cfg.ReleaseDir, version)
+	if err != nil {
+		log.Warnw("Failed to update current release link", "error", err, "requestId", ctx.id)
+	}
+}
+
+// rollbackSystemd restores the drop-in and release link which were in place before
+// a failed deployment, or removes the drop-in if there was none, and restarts the
+// unit.
+func (e *env) rollbackSystemd(ctx *Context, cfg Systemd, job *Job, previousDropIn []byte) {
+	// The deployment may have timed out, which should not prevent the rollback.
+	ctx = ctx.detached()
+
+	dropInPath := filepath.Join(cfg.dropInDir(), dropInFile)
+	var err error
+	if previousDropIn == nil {
+		err = os.Remove(dropInPath)
+	} else {
+		err = writeFileAtomic(dropInPath, previousDropIn, 0644)
+	}
+	if err != nil {
+		log.Errorw("Failed to restore unit drop-in", "error", err, "requestId", ctx.id)
+		return
+	}
+
+	if job.Previous != "" {
+		err = linkRelease(cfg.ReleaseDir, job.Previous)
+		if err != nil {
+			log.Errorw("Failed to restore current release link", "error", err, "requestId", ctx.id)
+			return
+		}
+	}
+
+	err = e.systemd.DaemonReload(ctx)
+	if err == nil {
+		err = e.systemd.Restart(ctx, cfg.Unit)
+	}
+	if err != nil {
+		log.Errorw("Failed to restart unit after rollback", "unit", cfg.Unit, "error", err, "requestId", ctx.id)
+		return
+	}
+
+	job.Status = jobRolledBack
+	log.Warnw("Rolled back to previous release", "unit", cfg.Unit, "version", job.Previous, "requestId", ctx.id)
+}
+
+// installRelease downloads the artifact for a version into its release directory,
+// provided that it matches the published checksum, and returns the sha256 digest
+// of the artifact.
+func (e *env) installRelease(ctx *Context, cfg Systemd, version string) (string, error) {
+	timeout := cfg.DownloadTimeout
+	if timeout == 0 {
+		timeout = defaultDownloadTimeout
+	}
+	ctx, cancel := ctx.withTimeout(timeout)
+	defer cancel()
+
+	checksum, err := downloadChecksum(ctx, strings.Replace(cfg.ChecksumURL, "{version}", version, -1))
+	if err != nil {
+		return "", err
+	}
+
+	u := strings.Replace(cfg.ArtifactURL, "{version}", version, -1)
+	log.Debugw("Downloading artifact", "url", u, "requestId", ctx.id)
+	res, err := download(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	dir := filepath.Join(cfg.ReleaseDir, version)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+cfg.Binary+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), res.Body)
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum != checksum {
+		log.Errorw("Artifact does not match published checksum", "url", u, "expected", checksum, "actual", sum, "requestId", ctx.id)
+		return "", errChecksumMismatch
+	}
+
+	err = os.Chmod(tmp.Name(), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(tmp.Name(), filepath.Join(dir, cfg.Binary))
+	if err != nil {
+		return "", err
+	}
+
+	return "sha256:" + sum, nil
+}
+
+// downloadChecksum fetches a sha256 checksum published in the format of
+// sha256sum, where the checksum is the first field.
+func downloadChecksum(ctx *Context, u string) (string, error) {
+	res, err := download(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 || !sha256Pattern.MatchString(strings.ToLower(fields[0])) {
+		return "", fmt.Errorf("Invalid checksum published at %s", u)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+func download(ctx *Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("Failed to download %s: %s", u, res.Status)
+	}
+	return res, nil
+}
+
+func (e *env) waitForUnit(ctx *Context, cfg Systemd) error {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultActiveTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		state, err := e.systemd.IsActive(ctx, cfg.Unit)
+		if err != nil {
+			return err
+		}
+
+		switch state {
+		case unitActive:
+			return nil
+		case unitFailed:
+			return errUnitNotActive
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(unitPollInterval):
+		}
+	}
+
+	return errUnitNotActive
+}
+
+// linkRelease points the current release link at a version.
+func linkRelease(releaseDir, version string) error {
+	tmp := filepath.Join(releaseDir, "."+currentRelease)
+	os.Remove(tmp)
+
+	err := os.Symlink(version, tmp)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(releaseDir, currentRelease))
+}
+
+// writeFileAtomic replaces a file by renaming a new temporary file over it, so
+// that readers never see a partial write and a symlink at the path is replaced
+// rather than followed.
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedeploySystemd(t *testing.T) {
+	assert := assert.New(t)
+
+	artifacts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/releases/1.2.0/svc":
+			w.WriteHeader(http.StatusNotFound)
+		case "/releases/1.4.0/svc.sha256":
+			w.Write([]byte(strings.Repeat("0", 64) + "  svc\n"))
+		default:
+			if strings.HasSuffix(r.URL.Path, ".sha256") {
+				w.Write([]byte("9A3A45D01531A20E89AC6AE10B0B0BEB0492ACD7216A368AA062D1A5FECAF9CD  svc\n"))
+				return
+			}
+			w.Write([]byte("binary"))
+		}
+	}))
+	defer artifacts.Close()
+
+	dir, err := ioutil.TempDir("", "redeployer-systemd")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	releaseDir := filepath.Join(dir, "releases")
+	assert.NoError(os.MkdirAll(filepath.Join(releaseDir, "1.0.0"), 0755))
+	assert.NoError(linkRelease(releaseDir, "1.0.0"))
+
+	target := Target{
+		ID:   "test-svc",
+		Type: typeSystemd,
+		Systemd: &Systemd{
+			Unit:        "test-svc.service",
+			ArtifactURL: artifacts.URL + "/releases/{version}/svc",
+			ChecksumURL: artifacts.URL + "/releases/{version}/svc.sha256",
+			ReleaseDir:  releaseDir,
+			Binary:      "svc",
+			Args:        "-port 9000",
+			DropInDir:   filepath.Join(dir, "test-svc.service.d"),
+			Timeout:     time.Second,
+		},
+	}
+	sm := &mockServiceManager{
+		states: []string{"activating", unitActive},
+	}
+	e := &env{systemd: sm}
+
+	job := newJob(newTestContext(), target, "1.1.0")
+	e.redeploySystemd(newTestContext(), target, job)
+	assert.Equal(jobRunning, job.Status)
+	assert.Equal("1.0.0", job.Previous)
+	assert.Equal("sha256:9a3a45d01531a20e89ac6ae10b0b0beb0492acd7216a368aa062d1a5fecaf9cd", job.Digest)
+	assert.Equal(1, sm.reloads)
+	assert.Equal([]string{"test-svc.service"}, sm.restarted)
+
+	binary, err := ioutil.ReadFile(filepath.Join(releaseDir, "1.1.0", "svc"))
+	assert.NoError(err)
+	assert.Equal("binary", string(binary))
+
+	dropIn, err := ioutil.ReadFile(filepath.Join(dir, "test-svc.service.d", "redeployer.conf"))
+	assert.NoError(err)
+	expected := "[Service]\nEnvironment=RELEASE_VERSION=1.1.0\nExecStart=\nExecStart=" + filepath.Join(releaseDir, "1.1.0", "svc") + " -port 9000\n"
+	assert.Equal(expected, string(dropIn))
+
+	current, err := e.currentImage(newTestContext(), target)
+	assert.NoError(err)
+	assert.Equal("1.1.0", current)
+
+	sm.states = []string{unitFailed}
+	sm.restarted = nil
+	job = newJob(newTestContext(), target, "1.3.0")
+	e.redeploySystemd(newTestContext(), target, job)
+	assert.Equal(jobRolledBack, job.Status)
+	assert.Equal(errUnitNotActive.Error(), job.Error)
+	assert.Equal([]string{"test-svc.service", "test-svc.service"}, sm.restarted)
+
+	dropIn, err = ioutil.ReadFile(filepath.Join(dir, "test-svc.service.d", "redeployer.conf"))
+	assert.NoError(err)
+	assert.Equal(expected, string(dropIn))
+
+	current, err = e.currentImage(newTestContext(), target)
+	assert.NoError(err)
+	assert.Equal("1.1.0", current)
+
+	sm.states = []string{unitActive}
+	sm.restartErr = fmt.Errorf("restart failed")
+	job = newJob(newTestContext(), target, "1.3.0")
+	e.redeploySystemd(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	sm.restartErr = nil
+
+	dropIn, err = ioutil.ReadFile(filepath.Join(dir, "test-svc.service.d", "redeployer.conf"))
+	assert.NoError(err)
+	assert.Equal(expected, string(dropIn))
+
+	job = newJob(newTestContext(), target, "1.2.0")
+	e.redeploySystemd(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+
+	job = newJob(newTestContext(), target, "1.4.0")
+	e.redeploySystemd(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal(errChecksumMismatch.Error(), job.Error)
+	_, err = os.Stat(filepath.Join(releaseDir, "1.4.0", "svc"))
+	assert.True(os.IsNotExist(err))
+
+	job = newJob(newTestContext(), target, "../1.2.0")
+	e.redeploySystemd(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal(errInvalidRelease.Error(), job.Error)
+
+	job = newJob(newTestContext(), target, currentRelease)
+	e.redeploySystemd(newTestContext(), target, job)
+	assert.Equal(jobFailed, job.Status)
+	assert.Equal(errInvalidRelease.Error(), job.Error)
+}
+
+func TestInstallRelease_timeout(t *testing.T) {
+	assert := assert.New(t)
+
+	stalled := make(chan struct{})
+	artifacts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("bin"))
+		w.(http.Flusher).Flush()
+		<-stalled
+	}))
+	defer artifacts.Close()
+	defer close(stalled)
+
+	dir, err := ioutil.TempDir("", "redeployer-systemd")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	e := &env{systemd: &mockServiceManager{}}
+	cfg := Systemd{
+		Unit:            "test-svc.service",
+		ArtifactURL:     artifacts.URL + "/releases/{version}/svc",
+		ChecksumURL:     artifacts.URL + "/releases/{version}/svc.sha256",
+		ReleaseDir:      dir,
+		Binary:          "svc",
+		DownloadTimeout: 100 * time.Millisecond,
+	}
+
+	start := time.Now()
+	_, err = e.installRelease(newTestContext(), cfg, "1.0.0")
+	assert.Error(err)
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+func TestWaitForUnit_cancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	e := &env{systemd: &mockServiceManager{states: []string{"activating"}}}
+	cfg := Systemd{Unit: "test-svc.service", Timeout: time.Minute}
+
+	ctx, cancel := newTestContext().withTimeout(100 * time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := e.waitForUnit(ctx, cfg)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+type mockServiceManager struct {
+	reloads    int
+	restarted  []string
+	restartErr error
+	states     []string
+}
+
+func (m *mockServiceManager) DaemonReload(ctx *Context) error {
+	m.reloads++
+	return nil
+}
+
+func (m *mockServiceManager) Restart(ctx *Context, unit string) error {
+	m.restarted = append(m.restarted, unit)
+	return m.restartErr
+}
+
+func (m *mockServiceManager) IsActive(ctx *Context, unit string) (string, error) {
+	state := m.states[0]
+	if len(m.states) > 1 {
+		m.states = m.states[1:]
+	}
+	return state, nil
+}
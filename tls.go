@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval how often the certificate files are checked for changes.
+const certCheckInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherSuites the cipher suites which may be enabled for TLS 1.2. Only
+// AEAD suites with forward secrecy are supported, TLS 1.3 suites are not
+// configurable.
+var tlsCipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+var defaultCipherSuites = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+}
+
+// TLS configures the service to serve HTTPS. The certificate and key are
+// reloaded when the files change, so renewed certificates are picked up without
+// a restart. The minimum version defaults to 1.2.
+//
+// Clients may authenticate with a certificate issued by the client CA instead of
+// a deploy token. The common name or a subject alternative name of the
+// certificate is mapped to an identity by ClientIdentities.
+type TLS struct {
+	CertFile     string   `yaml:"certFile,omitempty"`
+	KeyFile      string   `yaml:"keyFile,omitempty"`
+	MinVersion   string   `yaml:"minVersion,omitempty"`
+	CipherSuites []string `yaml:"cipherSuites,omitempty"`
+
+	ClientCAFile      string              `yaml:"clientCaFile,omitempty"`
+	RequireClientCert bool                `yaml:"requireClientCert,omitempty"`
+	ClientIdentities  map[string][]string `yaml:"clientIdentities,omitempty"`
+}
+
+func (t TLS) validate() error {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("tls requires certFile and keyFile")
+	}
+
+	if _, ok := tlsVersions[t.MinVersion]; !ok && t.MinVersion != "" {
+		return fmt.Errorf("unsupported tls version %q", t.MinVersion)
+	}
+
+	for _, name := range t.CipherSuites {
+		if _, ok := tlsCipherSuites[name]; !ok {
+			return fmt.Errorf("unsupported cipher suite %q", name)
+		}
+	}
+
+	if t.ClientCAFile == "" && (t.RequireClientCert || len(t.ClientIdentities) > 0) {
+		return fmt.Errorf("client certificates require clientCaFile")
+	}
+
+	mapped := make(map[string]string)
+	for identity, names := range t.ClientIdentities {
+		if len(names) == 0 {
+			return fmt.Errorf("client identity %q has no names", identity)
+		}
+		for _, name := range names {
+			if other, ok := mapped[name]; ok && other != identity {
+				return fmt.Errorf("%q maps to both %q and %q", name, other, identity)
+			}
+			mapped[name] = identity
+		}
+	}
+	return nil
+}
+
+// config returns the server TLS configuration, loading the certificate.
+func (t TLS) config() (*tls.Config, error) {
+	err := t.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := newCertReloader(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if t.MinVersion != "" {
+		minVersion = tlsVersions[t.MinVersion]
+	}
+
+	names := t.CipherSuites
+	if len(names) == 0 {
+		names = defaultCipherSuites
+	}
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		suites = append(suites, tlsCipherSuites[name])
+	}
+
+	cfg := &tls.Config{
+		MinVersion:               minVersion,
+		CipherSuites:             suites,
+		PreferServerCipherSuites: true,
+		GetCertificate:           reloader.GetCertificate,
+	}
+
+	if t.ClientCAFile != "" {
+		cfg.ClientCAs, err = clientCertPool(t.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return cfg, nil
+}
+
+// certReloader serves a certificate and key pair, reloading them when the
+// modification time of either file changes. A pair that fails to load, e.g.
+// because only one of the files has been replaced yet, is retried on the next
+// check while the current certificate continues to be served.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	r.checked = time.Now()
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the
+// files have changed since they were last checked.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checked = now
+
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		log.Errorw("Failed to check TLS certificate, keeping current", "error", err)
+		return r.cert, nil
+	}
+
+	if certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return r.cert, nil
+	}
+
+	err = r.reload()
+	if err != nil {
+		log.Errorw("Failed to reload TLS certificate, keeping current", "error", err)
+		return r.cert, nil
+	}
+
+	log.Infow("Reloaded TLS certificate", "certFile", r.certFile)
+	return r.cert, nil
+}
+
+func (r *certReloader) reload() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+	return nil
+}
+
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
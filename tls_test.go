@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLS_validate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(TLS{CertFile: "cert.pem", KeyFile: "key.pem"}.validate())
+	assert.NoError(TLS{
+		CertFile:     "cert.pem",
+		KeyFile:      "key.pem",
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}.validate())
+
+	assert.Error(TLS{CertFile: "cert.pem"}.validate())
+	assert.Error(TLS{CertFile: "cert.pem", KeyFile: "key.pem", MinVersion: "1.0"}.validate())
+	assert.Error(TLS{
+		CertFile:     "cert.pem",
+		KeyFile:      "key.pem",
+		CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"},
+	}.validate())
+}
+
+func TestCertReloader(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "redeployer-tls")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "first")
+	reloader, err := newCertReloader(certFile, keyFile)
+	assert.NoError(err)
+	assert.Equal("first", leafCommonName(t, reloader))
+
+	writeTestCertificate(t, dir, "second")
+	assert.Equal("first", leafCommonName(t, reloader))
+
+	later := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(certFile, later, later))
+	assert.NoError(os.Chtimes(keyFile, later, later))
+	reloader.checked = time.Time{}
+	assert.Equal("second", leafCommonName(t, reloader))
+
+	assert.NoError(ioutil.WriteFile(keyFile, []byte("garbage"), 0600))
+	reloader.checked = time.Time{}
+	assert.Equal("second", leafCommonName(t, reloader))
+
+	_, err = newCertReloader(filepath.Join(dir, "missing.pem"), keyFile)
+	assert.Error(err)
+}
+
+func TestServer_tls(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "redeployer-tls")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "localhost")
+	e := &env{
+		cfg: Config{
+			Authentication: AuthKey{
+				Key:  "alg=scrypt$N=16384$r=8$p=1$keyLen=32$hash=b8059f5d26826ef3af0faa424a8fc0f51f80bd62aa46ada056f7174e08a69739",
+				Salt: "478c1d403dec20707cf487f81c06d646",
+			},
+			TLS: &TLS{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"},
+		},
+		docker: &mockDockerClient{},
+	}
+	server := newServer(e, 9000)
+	assert.NotNil(server.TLSConfig)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	go server.Serve(tls.NewListener(listener, server.TLSConfig))
+	defer server.Close()
+
+	ca, err := ioutil.ReadFile(certFile)
+	assert.NoError(err)
+	roots := x509.NewCertPool()
+	assert.True(roots.AppendCertsFromPEM(ca))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"},
+		},
+	}
+	res, err := client.Get("https://" + listener.Addr().String() + "/health")
+	assert.NoError(err)
+	if err == nil {
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+	}
+
+	legacy := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost", MaxVersion: tls.VersionTLS12},
+		},
+	}
+	_, err = legacy.Get("https://" + listener.Addr().String() + "/health")
+	assert.Error(err)
+}
+
+// writeTestCertificate writes a self signed certificate for localhost, with the
+// common name as subject, to cert.pem and key.pem in a directory.
+func writeTestCertificate(t *testing.T, dir, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func leafCommonName(t *testing.T, reloader *certReloader) string {
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}